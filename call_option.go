@@ -0,0 +1,104 @@
+package go_rpc
+
+import (
+	"context"
+	"go-rpc/serialize"
+	"maps"
+	"time"
+)
+
+// CallOption 设置单次调用的参数，通过 CtxWithCallOptions 放在 context 里面，
+// 由 InitService 创建的方法读取
+type CallOption func(o *callOptions)
+
+type callOptions struct {
+	timeout    time.Duration
+	serializer serialize.Serializer
+	metadata   map[string]string
+	// waitForReady 为 false 的时候，拿不到可用的连接就立刻返回错误
+	waitForReady bool
+	idempotent   bool
+}
+
+// CallWithTimeout 设置这次调用的超时时间，context 里面已经有更早的 deadline 的时候使用更早的那个
+func CallWithTimeout(timeout time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.timeout = timeout
+	}
+}
+
+// CallWithSerializer 让这次调用使用另外一个序列化协议，服务端也必须支持它。
+// 客户端握手的时候总是会提议 JSON 和 Proto
+func CallWithSerializer(serializer serialize.Serializer) CallOption {
+	return func(o *callOptions) {
+		o.serializer = serializer
+	}
+}
+
+// reservedMetaKeys 是框架自己在元数据里面使用的字段
+var reservedMetaKeys = []string{"one-way", "deadline", "attempt"}
+
+// CallWithMetadata 给这次调用加上元数据，服务端通过 MetadataFromContext 读取。
+// 多次设置的时候合并在一起，one-way、deadline、attempt 这些框架自己使用的字段会被忽略
+func CallWithMetadata(md map[string]string) CallOption {
+	md = maps.Clone(md)
+	for _, key := range reservedMetaKeys {
+		delete(md, key)
+	}
+	return func(o *callOptions) {
+		if o.metadata == nil {
+			o.metadata = make(map[string]string, len(md))
+		}
+		maps.Copy(o.metadata, md)
+	}
+}
+
+// CallWithWaitForReady 设置客户端还没有可用连接的时候，这次调用是不是等待连接建立。
+// 默认是 fail fast，正在建立连接的时候等待它的结果，建立连接失败的时候立刻返回错误；
+// 等待的时候直到连接建立或者 context 结束才返回
+func CallWithWaitForReady(waitForReady bool) CallOption {
+	return func(o *callOptions) {
+		o.waitForReady = waitForReady
+	}
+}
+
+// CallWithIdempotent 把这次调用标记为幂等的，ClientWithRetryPolicy 设置了重试策略的时候可以重试
+func CallWithIdempotent() CallOption {
+	return func(o *callOptions) {
+		o.idempotent = true
+	}
+}
+
+type callOptionsKey struct{}
+
+// CtxWithCallOptions 把调用参数放到 context 里面，ctx 里面已经有的参数会被保留，相同的参数使用新的值
+func CtxWithCallOptions(ctx context.Context, opts ...CallOption) context.Context {
+	o := callOptionsFromContext(ctx)
+	// 复制一份，不修改父 context 里面的参数
+	o.metadata = maps.Clone(o.metadata)
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return context.WithValue(ctx, callOptionsKey{}, o)
+}
+
+func callOptionsFromContext(ctx context.Context) callOptions {
+	o, _ := ctx.Value(callOptionsKey{}).(callOptions)
+	return o
+}
+
+type metadataKey struct{}
+
+func ctxWithMetadata(ctx context.Context, md map[string]string) context.Context {
+	if len(md) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataFromContext 在服务端返回客户端传过来的元数据，包括 deadline 这样框架自己使用的字段。
+// 返回的 map 不能修改
+func MetadataFromContext(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(metadataKey{}).(map[string]string)
+	return md
+}
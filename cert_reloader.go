@@ -0,0 +1,249 @@
+package go_rpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultCertReloadInterval = time.Minute
+
+// RotationEvent 描述一次证书加载的结果
+type RotationEvent struct {
+	CertFile string
+	// NotAfter 是当前使用的证书的过期时间
+	NotAfter time.Time
+	// Err 不为 nil 表示加载失败，这时候继续使用原来的证书
+	Err error
+}
+
+// CertReloader 定期检查证书、私钥和 CA 文件，文件变化之后重新加载。
+// 新的证书只用于之后的 TLS 握手，已经建立的连接不受影响
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	interval time.Duration
+	onRotate func(event RotationEvent)
+
+	// 证书和 CA 放在一起替换，握手的时候不会看到新证书和旧 CA 混在一起
+	state atomic.Pointer[certState]
+
+	// modTimes 是上一次加载的时候文件的修改时间
+	modTimes []time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// certState 是一次加载的结果，pool 为 nil 表示没有设置 CA 文件
+type certState struct {
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+// serverConfigCache 是根据某一次加载的结果生成的服务端配置
+type serverConfigCache struct {
+	state  *certState
+	config *tls.Config
+}
+
+type CertReloaderOption func(r *CertReloader)
+
+// CertReloaderWithInterval 设置检查文件的间隔
+func CertReloaderWithInterval(interval time.Duration) CertReloaderOption {
+	return func(r *CertReloader) {
+		r.interval = interval
+	}
+}
+
+// CertReloaderWithHook 设置加载证书之后的回调，包括第一次加载和加载失败
+func CertReloaderWithHook(fn func(event RotationEvent)) CertReloaderOption {
+	return func(r *CertReloader) {
+		r.onRotate = fn
+	}
+}
+
+// NewCertReloader 加载证书并且开始监听文件的变化。
+// caFile 为空的时候不替换对端证书的 CA，继续使用 tls.Config 里面的设置
+func NewCertReloader(certFile, keyFile, caFile string, opts ...CertReloaderOption) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		interval: DefaultCertReloadInterval,
+		onRotate: func(event RotationEvent) {},
+		closed:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
+
+func (r *CertReloader) watch() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if r.changed() {
+				_ = r.reload()
+			}
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+func (r *CertReloader) files() []string {
+	if r.caFile == "" {
+		return []string{r.certFile, r.keyFile}
+	}
+	return []string{r.certFile, r.keyFile, r.caFile}
+}
+
+func (r *CertReloader) statFiles() ([]time.Time, error) {
+	files := r.files()
+	modTimes := make([]time.Time, 0, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+func (r *CertReloader) changed() bool {
+	modTimes, err := r.statFiles()
+	if err != nil {
+		// 文件可能正在被替换，下一次再检查
+		return false
+	}
+	for i, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload 加载所有的文件，只有全部成功才会替换正在使用的证书
+func (r *CertReloader) reload() error {
+	modTimes, err := r.statFiles()
+	if err == nil {
+		// 加载失败也记录修改时间，文件再次变化之后才重试，避免每次检查都报告同一个错误
+		r.modTimes = modTimes
+		err = r.load()
+	}
+	event := RotationEvent{CertFile: r.certFile, Err: err}
+	if state := r.state.Load(); state != nil {
+		event.NotAfter = state.cert.Leaf.NotAfter
+	}
+	r.onRotate(event)
+	return err
+}
+
+func (r *CertReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("go-rpc: no certificate found in %s", r.caFile)
+		}
+	}
+	r.state.Store(&certState{cert: &cert, pool: pool})
+	return nil
+}
+
+// Certificate 返回当前使用的证书
+func (r *CertReloader) Certificate() *tls.Certificate {
+	return r.state.Load().cert
+}
+
+// ServerConfig 基于 base 生成服务端的配置，每次握手都会使用最新的证书和 CA。
+// 每次加载之后只生成一次配置，同一个证书的连接共用它，会话票据的密钥也不会变。
+// base 设置了 GetConfigForClient 的时候先调用它，它返回的配置也换成最新的证书和 CA
+func (r *CertReloader) ServerConfig(base *tls.Config) *tls.Config {
+	if base == nil {
+		base = &tls.Config{}
+	}
+	config := base.Clone()
+	getConfig := base.GetConfigForClient
+	var cache atomic.Pointer[serverConfigCache]
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		state := r.state.Load()
+		if getConfig != nil {
+			c, err := getConfig(hello)
+			if err != nil || c != nil {
+				if c != nil {
+					c = c.Clone()
+					state.applyServer(c)
+				}
+				return c, err
+			}
+		}
+		if c := cache.Load(); c != nil && c.state == state {
+			return c.config, nil
+		}
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		state.applyServer(c)
+		cache.Store(&serverConfigCache{state: state, config: c})
+		return c, nil
+	}
+	return config
+}
+
+// applyServer 让服务端的配置使用这次加载的证书和 CA
+func (s *certState) applyServer(c *tls.Config) {
+	c.Certificates = []tls.Certificate{*s.cert}
+	if s.pool != nil {
+		c.ClientCAs = s.pool
+	}
+}
+
+// ClientConfig 基于 base 生成客户端的配置，使用当前的证书和 CA
+func (r *CertReloader) ClientConfig(base *tls.Config) *tls.Config {
+	if base == nil {
+		base = &tls.Config{}
+	}
+	state := r.state.Load()
+	config := base.Clone()
+	config.Certificates = []tls.Certificate{*state.cert}
+	if state.pool != nil {
+		config.RootCAs = state.pool
+	}
+	return config
+}
+
+// Close 停止监听文件，可以重复调用
+func (r *CertReloader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+	return nil
+}
@@ -0,0 +1,210 @@
+package go_rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	issueServer := func(cn string, ttl time.Duration) tls.Certificate {
+		return ca.issue(t, cn, ttl, func(tmpl *x509.Certificate) {
+			tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+			tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		})
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	first := issueServer("server-a", time.Hour)
+	writeCert(t, certFile, keyFile, first, time.Now().Add(-time.Minute))
+
+	events := make(chan RotationEvent, 8)
+	reloader, err := NewCertReloader(certFile, keyFile, "",
+		CertReloaderWithInterval(10*time.Millisecond),
+		CertReloaderWithHook(func(event RotationEvent) {
+			events <- event
+		}))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = reloader.Close()
+	})
+	event := <-events
+	require.NoError(t, event.Err)
+	assert.Equal(t, first.Leaf.NotAfter, event.NotAfter)
+
+	server := NewServer(ServerWithCertReloader(reloader))
+	server.RegisterService(&UserServiceServer{})
+	addr := startServer(t, server)
+
+	usClient := &UserService{}
+	client, err := NewClient(addr, ClientWithTLSConfig(&tls.Config{RootCAs: ca.pool}))
+	require.NoError(t, err)
+	require.NoError(t, client.InitService(usClient))
+	_, err = usClient.GetById(context.Background(), &GetByIdReq{Id: 123})
+	require.NoError(t, err)
+	assert.Equal(t, "server-a", servedCommonName(t, addr, ca.pool))
+	// 同一次加载的证书共用一个配置
+	serverConfig := reloader.ServerConfig(nil)
+	firstConfig, err := serverConfig.GetConfigForClient(nil)
+	require.NoError(t, err)
+	config, err := serverConfig.GetConfigForClient(nil)
+	require.NoError(t, err)
+	assert.Same(t, firstConfig, config)
+
+	// 写坏的文件不会替换正在使用的证书
+	require.NoError(t, os.WriteFile(certFile, []byte("broken"), 0o600))
+	require.NoError(t, os.Chtimes(certFile, time.Now(), time.Now()))
+	event = <-events
+	assert.Error(t, event.Err)
+	assert.Equal(t, first.Leaf.NotAfter, event.NotAfter)
+	assert.Equal(t, "server-a", servedCommonName(t, addr, ca.pool))
+
+	second := issueServer("server-b", 2*time.Hour)
+	writeCert(t, certFile, keyFile, second, time.Now().Add(time.Minute))
+	event = waitRotation(t, events)
+	assert.Equal(t, second.Leaf.NotAfter, event.NotAfter)
+
+	// 新的连接使用新的证书，已经建立的连接不受影响
+	assert.Equal(t, "server-b", servedCommonName(t, addr, ca.pool))
+	config, err = serverConfig.GetConfigForClient(nil)
+	require.NoError(t, err)
+	assert.NotSame(t, firstConfig, config)
+	_, err = usClient.GetById(context.Background(), &GetByIdReq{Id: 123})
+	assert.NoError(t, err)
+}
+
+func TestCertReloader_ServerConfigCallback(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	cert := ca.issue(t, "server", time.Hour, func(tmpl *x509.Certificate) {})
+	writeCert(t, certFile, keyFile, cert, time.Now())
+	reloader, err := NewCertReloader(certFile, keyFile, "")
+	require.NoError(t, err)
+	defer reloader.Close()
+
+	// base 里面原来的回调按照 SNI 选择配置，没有选中的时候返回 nil
+	config := reloader.ServerConfig(&tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if hello.ServerName != "strict" {
+				return nil, nil
+			}
+			return &tls.Config{MinVersion: tls.VersionTLS13}, nil
+		},
+	})
+	strict, err := config.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "strict"})
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), strict.MinVersion)
+	assert.Equal(t, cert.Certificate, strict.Certificates[0].Certificate)
+
+	other, err := config.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "other"})
+	require.NoError(t, err)
+	assert.Equal(t, uint16(0), other.MinVersion)
+	assert.Equal(t, cert.Certificate, other.Certificates[0].Certificate)
+}
+
+func TestCertReloader_Client(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "server", time.Hour, func(tmpl *x509.Certificate) {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	})
+	server := NewServer(ServerWithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}))
+	service := &UserServiceServerPeer{}
+	server.RegisterService(service)
+	addr := startServer(t, server)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: ca.cert.Raw,
+	}), 0o600))
+	issueClient := func(cn string) tls.Certificate {
+		return ca.issue(t, cn, time.Hour, func(tmpl *x509.Certificate) {
+			tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		})
+	}
+	writeCert(t, certFile, keyFile, issueClient("client-a"), time.Now().Add(-time.Minute))
+
+	events := make(chan RotationEvent, 8)
+	reloader, err := NewCertReloader(certFile, keyFile, caFile,
+		CertReloaderWithInterval(10*time.Millisecond),
+		CertReloaderWithHook(func(event RotationEvent) {
+			events <- event
+		}))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = reloader.Close()
+	})
+	<-events
+
+	call := func() string {
+		usClient := &UserService{}
+		client, err := NewClient(addr, ClientWithCertReloader(reloader))
+		require.NoError(t, err)
+		require.NoError(t, client.InitService(usClient))
+		resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 123})
+		require.NoError(t, err)
+		return resp.Msg
+	}
+	assert.Equal(t, "client-a", call())
+
+	writeCert(t, certFile, keyFile, issueClient("client-b"), time.Now().Add(time.Minute))
+	waitRotation(t, events)
+	assert.Equal(t, "client-b", call())
+}
+
+// waitRotation 等待一次成功的加载。
+// 文件是一个一个写的，中间可能会读到证书和私钥不匹配的状态
+func waitRotation(t *testing.T, events chan RotationEvent) RotationEvent {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Err == nil {
+				return event
+			}
+		case <-timeout:
+			t.Fatal("证书没有更新")
+		}
+	}
+}
+
+// writeCert 把证书和私钥写成 PEM 文件，并且设置修改时间
+func writeCert(t *testing.T, certFile, keyFile string, cert tls.Certificate, modTime time.Time) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "PRIVATE KEY", Bytes: key,
+	}), 0o600))
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: cert.Certificate[0],
+	}), 0o600))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+}
+
+// servedCommonName 建立一个新的 TLS 连接，返回服务端证书的名字
+func servedCommonName(t *testing.T, addr string, pool *x509.CertPool) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
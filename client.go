@@ -2,92 +2,648 @@ package go_rpc
 
 import (
 	"context"
-	"github.com/silenceper/pool"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go-rpc/compress"
 	"go-rpc/internal/errs"
 	"go-rpc/message"
 	"go-rpc/serialize"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// DefaultDialTimeout 是建立连接和握手的默认超时时间
+	DefaultDialTimeout = time.Second * 3
+	// DefaultIdleTimeout 是连接池里面的连接空闲多久之后被关闭
+	DefaultIdleTimeout = time.Minute
+	// DefaultHealthCheckIdle 是连接空闲多久之后，再次使用之前要先确认它还能用
+	DefaultHealthCheckIdle = time.Second * 5
+	// DefaultDialBackoff 和 DefaultMaxDialBackoff 是建立连接失败之后等待的初始时间和最长时间
+	DefaultDialBackoff    = time.Millisecond * 100
+	DefaultMaxDialBackoff = time.Second * 10
+)
+
 type Client struct {
-	pool       pool.Pool
+	addr       string
 	serializer serialize.Serializer
+	compressor compress.Compressor
+
+	// reqId 用于生成请求 ID，同一个连接上的响应靠它来分发
+	reqId atomic.Uint32
+
+	maxHeaderSize uint32
+	maxBodySize   uint32
+
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+
+	transport    Transport
+	tlsConfig    *tls.Config
+	certReloader *CertReloader
+
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// 连接池。每个连接都是多路复用的，默认只使用一个连接
+	initialCap  int
+	maxCap      int
+	maxIdle     int
+	idleTimeout time.Duration
+
+	healthCheckIdle time.Duration
+	dialBackoff     time.Duration
+	maxDialBackoff  time.Duration
+
+	mutex   sync.Mutex
+	conns   []*clientConn
+	dialing int
+	closed  bool
+	// 建立连接连续失败的次数和最后一次的错误，成功之后清零。
+	// nextDial 之前不会再尝试建立连接
+	dialFailures int
+	dialErr      error
+	nextDial     time.Time
+	// totalDialFailures 是建立连接失败的总次数
+	totalDialFailures uint64
+
+	retryPolicy RetryPolicy
+	idempotent  map[string]bool
+
+	// nonBlocking 的时候 NewClient 不等待连接建立，connect 在后台建立连接
+	nonBlocking bool
+	connecting  bool
+	done        chan struct{}
+	// state 变化的时候关闭 stateCh，然后换一个新的
+	state   ConnState
+	stateCh chan struct{}
 }
 
-func NewClient(addr string) (*Client, error) {
-	p, err := pool.NewChannelPool(&pool.Config{
-		InitialCap:  1,
-		MaxCap:      30,
-		MaxIdle:     10,
-		IdleTimeout: time.Minute,
-		Factory: func() (interface{}, error) {
-			return net.DialTimeout("tcp", addr, time.Second*3)
-		},
-		Close: func(i interface{}) error {
-			return i.(net.Conn).Close()
-		},
-	})
-	if err != nil {
-		return nil, err
+// ClientStats 是连接池的状态
+type ClientStats struct {
+	// Open 是连接池里面的连接数，等于 Idle 加上 InUse
+	Open int
+	// Idle 是没有调用在使用的连接数
+	Idle int
+	// InUse 是有调用在使用的连接数
+	InUse int
+	// DialFailures 是建立连接失败的总次数
+	DialFailures uint64
+}
+
+type ClientOption func(c *Client)
+
+// ClientWithFrameLimits 限制服务端响应的头部和 body 的大小
+func ClientWithFrameLimits(maxHeaderSize, maxBodySize uint32) ClientOption {
+	return func(c *Client) {
+		c.maxHeaderSize = maxHeaderSize
+		c.maxBodySize = maxBodySize
 	}
-	return &Client{
-		pool:       p,
-		serializer: &serialize.JsonSerializer{},
-	}, nil
 }
 
-func (c *Client) Invoke(ctx context.Context, req *message.Request) (*message.Response, error) {
-	if ctx.Err() != nil {
-		return nil, ctx.Err()
+// ClientWithHeartbeat 设置心跳。连接空闲超过 interval 就发送 ping，
+// 超过 timeout 没有收到服务端的任何数据就关闭连接，下一次调用会重新建立连接。
+// interval 为 0 的时候关闭心跳
+func ClientWithHeartbeat(interval, timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.heartbeatInterval = interval
+		c.heartbeatTimeout = timeout
+	}
+}
+
+// ClientWithSerializer 设置请求使用的序列化协议，默认是 JSON
+func ClientWithSerializer(serializer serialize.Serializer) ClientOption {
+	return func(c *Client) {
+		c.serializer = serializer
+	}
+}
+
+// ClientWithCompressor 设置请求使用的压缩算法，服务端用同样的算法压缩响应。默认不压缩。
+// 握手的时候服务端不支持压缩的连接上不压缩
+func ClientWithCompressor(compressor compress.Compressor) ClientOption {
+	return func(c *Client) {
+		c.compressor = compressor
+	}
+}
+
+// ClientWithPool 设置连接池。每个连接都可以同时发送多个请求，
+// 只有所有的连接上都有还没完成的调用，并且连接数小于 maxCap 的时候才会建立新的连接。
+// NewClient 预先建立 initialCap 个连接；没有调用的连接超过 maxIdle 个，
+// 或者空闲超过 idleTimeout 的时候会被关闭，idleTimeout 为 0 的时候不按照时间关闭
+func ClientWithPool(initialCap, maxCap, maxIdle int, idleTimeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.initialCap = initialCap
+		c.maxCap = maxCap
+		c.maxIdle = maxIdle
+		c.idleTimeout = idleTimeout
+	}
+}
+
+// ClientWithHealthCheck 设置连接空闲多久之后，再次使用之前先发送 ping 确认它还能用，
+// 在超时时间内没有收到 pong 的连接会被关闭。只对 Version3 的连接生效，idle 为 0 的时候不检查
+func ClientWithHealthCheck(idle time.Duration) ClientOption {
+	return func(c *Client) {
+		c.healthCheckIdle = idle
+	}
+}
+
+// ClientWithDialBackoff 设置建立连接失败之后的退避时间。
+// 连续失败的时候等待时间从 base 开始翻倍，不超过 max，并且加上正负 20% 的随机抖动。
+// 等待期间 fail fast 的调用直接返回上一次的错误
+func ClientWithDialBackoff(base, max time.Duration) ClientOption {
+	return func(c *Client) {
+		c.dialBackoff = base
+		c.maxDialBackoff = max
+	}
+}
+
+// ClientWithDialTimeout 设置建立连接和握手的超时时间
+func ClientWithDialTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.dialTimeout = timeout
+	}
+}
+
+// ClientWithReadTimeout 设置每次调用等待响应的最长时间。
+// 连接是多路复用的，所以它不是连接上的读超时。为 0 的时候只受 context 控制
+func ClientWithReadTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.readTimeout = timeout
+	}
+}
+
+// ClientWithWriteTimeout 设置每次写连接的超时时间，写超时的连接会被关闭
+func ClientWithWriteTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.writeTimeout = timeout
+	}
+}
+
+// ClientWithTransport 设置建立连接的方式，默认是 TCP
+func ClientWithTransport(transport Transport) ClientOption {
+	return func(c *Client) {
+		c.transport = transport
+	}
+}
+
+// ClientWithTLSConfig 让客户端使用 TLS。
+// config.ServerName 为空的时候用 addr 里面的主机名校验服务端证书，
+// 双向认证的时候在 config.Certificates 里面设置客户端证书
+func ClientWithTLSConfig(config *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+// ClientWithCertReloader 让客户端使用 reloader 加载的证书和 CA，
+// 每次建立新的连接都会使用最新的证书。ClientWithTLSConfig 设置的配置会作为基础配置
+func ClientWithCertReloader(reloader *CertReloader) ClientOption {
+	return func(c *Client) {
+		c.certReloader = reloader
+	}
+}
+
+// ClientWithNonBlocking 让 NewClient 不等待连接建立，服务端不可达的时候也不会返回错误。
+// 客户端从 StateConnecting 开始，在后台按照退避时间不断重试，连接全部断开之后也会在后台重新建立连接。
+// 建立连接失败之后 fail fast 的调用返回错误，通过 CallWithWaitForReady 可以让调用等待连接建立
+func ClientWithNonBlocking() ClientOption {
+	return func(c *Client) {
+		c.nonBlocking = true
+	}
+}
+
+// NewClient 创建客户端。addr 以 unix: 开头的时候使用 Unix domain socket，
+// 例如 unix:///var/run/go-rpc.sock 或者 unix:@go-rpc；
+// 以 ws:// 或者 wss:// 开头的时候使用 WebSocket，以 http:// 或者 https:// 开头的时候使用 HTTP。
+//
+// 建立连接之后先发送握手请求，服务端至少要是支持多路复用的版本：不认识握手的服务端回复服务不存在，
+// 客户端退回到 Version1。最早的服务端处理不存在的服务的时候会因为空指针 panic，不能和这个客户端一起使用
+func NewClient(addr string, opts ...ClientOption) (*Client, error) {
+	transport, addr := parseAddr(addr)
+	c := &Client{
+		addr:              addr,
+		serializer:        &serialize.JsonSerializer{},
+		maxHeaderSize:     DefaultMaxHeaderSize,
+		maxBodySize:       DefaultMaxBodySize,
+		heartbeatInterval: DefaultHeartbeatInterval,
+		heartbeatTimeout:  DefaultHeartbeatTimeout,
+		transport:         transport,
+		dialTimeout:       DefaultDialTimeout,
+		initialCap:        1,
+		maxCap:            1,
+		maxIdle:           1,
+		idleTimeout:       DefaultIdleTimeout,
+		healthCheckIdle:   DefaultHealthCheckIdle,
+		dialBackoff:       DefaultDialBackoff,
+		maxDialBackoff:    DefaultMaxDialBackoff,
+		done:              make(chan struct{}),
+		stateCh:           make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.maxCap < 1 {
+		c.maxCap = 1
+	}
+	if c.nonBlocking {
+		c.mutex.Lock()
+		c.startConnectLocked()
+		c.mutex.Unlock()
+		return c, nil
+	}
+	// 预先建立连接，保持服务端不可达时立刻报错的行为
+	for i := 0; i < c.initialConns(); i++ {
+		cc, err := c.newConn()
+		c.mutex.Lock()
+		c.recordDialLocked(err)
+		if err == nil {
+			c.addConnLocked(cc)
+		}
+		c.mutex.Unlock()
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
 	}
+	return c, nil
+}
 
-	ch := make(chan struct{})
+func (c *Client) initialConns() int {
+	return min(max(c.initialCap, 1), c.maxCap)
+}
 
-	var (
-		resp *message.Response
-		err  error
-	)
-	go func() {
-		resp, err = c.doInvoke(ctx, req)
-		close(ch)
-	}()
+// Close 关闭连接池里面所有的连接，还在等待响应的调用会返回错误，之后的调用返回 errs.ErrClientClosed
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	for _, cc := range c.conns {
+		cc.close(errs.ErrClientClosed)
+	}
+	c.conns = nil
+	c.updateStateLocked()
+	return nil
+}
+
+// Stats 返回连接池的状态
+func (c *Client) Stats() ClientStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := ClientStats{
+		Open:         len(c.conns),
+		DialFailures: c.totalDialFailures,
+	}
+	for _, cc := range c.conns {
+		if cc.calls > 0 {
+			stats.InUse++
+		}
+	}
+	stats.Idle = stats.Open - stats.InUse
+	return stats
+}
 
-	select {
-	case <-ctx.Done():
+func (c *Client) Invoke(ctx context.Context, req *message.Request) (*message.Response, error) {
+	if ctx.Err() != nil {
 		return nil, ctx.Err()
-	case <-ch:
-		return resp, err
 	}
+	if c.retryPolicy.MaxAttempts > 1 && !isOneway(ctx) && c.isIdempotent(ctx, req) {
+		return c.invokeWithRetry(ctx, req)
+	}
+	return c.doInvoke(ctx, req)
 }
 
 func (c *Client) doInvoke(ctx context.Context, req *message.Request) (*message.Response, error) {
+	cc, err := c.getConn(ctx, callOptionsFromContext(ctx).waitForReady)
+	if err != nil {
+		return nil, err
+	}
+	defer c.putConn(cc)
+	if err = cc.checkSerializer(req.Serializer); err != nil {
+		return nil, err
+	}
+	// 只有握手的时候服务端同意了压缩才压缩，不认识压缩的老服务端收到的还是原始数据
+	if c.compressor != nil && len(req.Data) > 0 && cc.features&message.FeatureCompression != 0 {
+		if req.Data, err = c.compressor.Compress(req.Data); err != nil {
+			return nil, err
+		}
+		req.Compresser = c.compressor.Code()
+		if cc.version >= message.Version3 {
+			req.Flags |= message.FlagCompressed
+		}
+	}
+	if c.readTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.readTimeout)
+		defer cancel()
+	}
+	req.Kind = message.KindRequest
+	req.RequestId = c.reqId.Add(1)
+	req.Version = cc.version
+	if isOneway(ctx) {
+		// Version3 开始用标记位表达 oneway，之前的版本只能放在元数据里面
+		if req.Version >= message.Version3 {
+			req.Flags |= message.FlagOneway
+		} else {
+			if req.Meta == nil {
+				req.Meta = make(map[string]string, 1)
+			}
+			req.Meta["one-way"] = "true"
+		}
+	}
 	req.CalculateHeaderLength()
 	req.CalculateBodyLength()
-	data := req.Encode()
-	resp, err := c.Send(ctx, data)
+	resp, err := cc.send(ctx, req)
+	if err != nil || resp.Compresser == 0 || len(resp.Data) == 0 {
+		return resp, err
+	}
+	if c.compressor == nil || c.compressor.Code() != resp.Compresser {
+		return resp, fmt.Errorf("%w: %d", errs.ErrCompressorNotSupported, resp.Compresser)
+	}
+	resp.Data, err = c.compressor.Decompress(resp.Data, c.maxBodySize)
+	return resp, err
+}
+
+// getConn 从连接池里面取出一个连接，调用结束之后要用 putConn 放回去。
+// 空闲太久的连接在使用之前先检查一下，检查失败的连接会被关闭，然后重新取一个。
+// 正在建立连接的时候总是等待它的结果，fail fast 的调用只在建立连接失败的时候返回错误；
+// waitForReady 的时候拿不到连接不会返回错误，而是等到连接建立或者 ctx 结束
+func (c *Client) getConn(ctx context.Context, waitForReady bool) (*clientConn, error) {
+	for {
+		cc, check, err := c.acquire()
+		if err != nil {
+			wait := errors.Is(err, errs.ErrClientConnecting) || waitForReady && !errors.Is(err, errs.ErrClientClosed)
+			if !wait {
+				return nil, err
+			}
+			if err = c.waitForRetry(ctx); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !check {
+			return cc, nil
+		}
+		if err = c.healthCheck(cc); err == nil {
+			return cc, nil
+		}
+		cc.close(err)
+		c.putConn(cc)
+	}
+}
+
+// acquire 优先使用调用最少的连接，所有的连接都有调用并且还没有达到上限的时候建立新的连接。
+// 断开的连接和服务端通知了要退出的连接会被移出连接池。
+// check 表示连接空闲太久，使用之前需要检查
+func (c *Client) acquire() (cc *clientConn, check bool, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	defer c.updateStateLocked()
+	if c.closed {
+		return nil, false, errs.ErrClientClosed
+	}
+	cc = c.pickLocked()
+	if cc != nil && (cc.calls == 0 || len(c.conns)+c.dialing >= c.maxCap) {
+		return cc, c.takeLocked(cc), nil
+	}
+	// 退避期间不建立连接，没有可用连接的时候直接返回上一次的错误
+	if time.Now().Before(c.nextDial) {
+		if cc == nil {
+			return nil, false, c.dialErr
+		}
+		return cc, c.takeLocked(cc), nil
+	}
+	// 后台正在建立连接，不用再建立一个
+	if cc == nil && c.dialing > 0 && c.dialing >= c.maxCap {
+		return nil, false, errs.ErrClientConnecting
+	}
+	c.dialing++
+	c.updateStateLocked()
+	c.mutex.Unlock()
+
+	// 建立连接的时候不持有锁，其它调用还可以使用已有的连接
+	newCC, err := c.newConn()
+	c.mutex.Lock()
+	c.dialing--
+	c.recordDialLocked(err)
+	if err == nil && c.closed {
+		newCC.close(errs.ErrClientClosed)
+		return nil, false, errs.ErrClientClosed
+	}
 	if err != nil {
-		return nil, err
+		// 已经有可用连接的时候用它，不让这次调用失败
+		if cc != nil && cc.isAvailable() {
+			cc.calls++
+			return cc, false, nil
+		}
+		return nil, false, err
+	}
+	c.addConnLocked(newCC)
+	newCC.calls++
+	return newCC, false, nil
+}
+
+// takeLocked 把连接标记为使用中，返回使用之前需不需要检查
+func (c *Client) takeLocked(cc *clientConn) bool {
+	check := c.healthCheckIdle > 0 && cc.calls == 0 && cc.version >= message.Version3 &&
+		time.Since(cc.lastUsed) >= c.healthCheckIdle
+	cc.calls++
+	return check
+}
+
+// addConnLocked 把新建立的连接放进连接池，连接断开的时候更新状态
+func (c *Client) addConnLocked(cc *clientConn) {
+	cc.lastUsed = time.Now()
+	cc.setOnClose(c.connLost)
+	c.conns = append(c.conns, cc)
+}
+
+// healthCheck 发送 ping 确认连接还能用
+func (c *Client) healthCheck(cc *clientConn) error {
+	ctx := context.Background()
+	if c.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.dialTimeout)
+		defer cancel()
+	}
+	return cc.ping(ctx)
+}
+
+// recordDialLocked 记录建立连接的结果，连续失败的时候按照指数退避
+func (c *Client) recordDialLocked(err error) {
+	defer c.updateStateLocked()
+	if err == nil {
+		c.dialFailures = 0
+		c.dialErr = nil
+		c.nextDial = time.Time{}
+		return
+	}
+	c.totalDialFailures++
+	c.dialFailures++
+	c.dialErr = err
+	if c.dialBackoff <= 0 {
+		return
+	}
+	backoff := c.maxDialBackoff
+	if shift := c.dialFailures - 1; shift < 32 {
+		backoff = min(c.dialBackoff<<shift, c.maxDialBackoff)
+	}
+	c.nextDial = time.Now().Add(jitter(backoff))
+}
+
+// putConn 在调用结束之后把连接放回连接池
+func (c *Client) putConn(cc *clientConn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cc.calls--
+	cc.lastUsed = time.Now()
+	// 服务端要退出的连接上最后一个调用结束了，关闭之后由 connLost 移出连接池
+	if cc.calls == 0 && cc.draining.Load() {
+		cc.close(nil)
+	}
+}
+
+// pickLocked 清理不可用的连接和多余的空闲连接，返回调用最少的连接。调用者必须持有 mutex
+func (c *Client) pickLocked() *clientConn {
+	var best *clientConn
+	alive := c.conns[:0]
+	for _, cc := range c.conns {
+		if !cc.isAvailable() {
+			// 服务端要退出的连接上还有调用的时候留在连接池里面，Close 还能关闭它，
+			// 最后一个调用结束之后 putConn 会关闭它
+			if !cc.isClosed() && cc.calls > 0 {
+				alive = append(alive, cc)
+				continue
+			}
+			cc.close(nil)
+			continue
+		}
+		alive = append(alive, cc)
+		if best == nil || cc.calls < best.calls {
+			best = cc
+		}
+	}
+	clear(c.conns[len(alive):])
+	c.conns = alive
+
+	idle := 0
+	if best != nil && best.calls == 0 {
+		idle++
 	}
-	return message.DecodeRes(resp), nil
+	now := time.Now()
+	kept := c.conns[:0]
+	for _, cc := range c.conns {
+		if cc != best && cc.calls == 0 {
+			idle++
+			if idle > c.maxIdle || (c.idleTimeout > 0 && now.Sub(cc.lastUsed) > c.idleTimeout) {
+				cc.close(nil)
+				continue
+			}
+		}
+		kept = append(kept, cc)
+	}
+	clear(c.conns[len(kept):])
+	c.conns = kept
+	return best
 }
 
-func (c *Client) Send(ctx context.Context, data []byte) ([]byte, error) {
-	val, err := c.pool.Get()
+// newConn 建立连接，完成握手之后开启心跳
+func (c *Client) newConn() (*clientConn, error) {
+	ctx := context.Background()
+	if c.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.dialTimeout)
+		defer cancel()
+	}
+	cc, err := c.openConn(ctx)
 	if err != nil {
 		return nil, err
 	}
-	conn := val.(net.Conn)
-	defer func() {
-		_ = c.pool.Put(val)
-	}()
-	_, err = conn.Write(data)
+	err = cc.handshake(ctx, c.reqId.Add(1), c.proposedSerializers())
+	if errors.Is(err, errHandshakeClosed) {
+		// 服务端不认识握手，重新建立连接，不握手直接使用 Version1
+		if cc, err = c.openConn(ctx); err != nil {
+			return nil, err
+		}
+		cc.version = message.Version1
+		cc.serializers = c.proposedSerializers()
+	}
+	if err == nil {
+		err = cc.checkSerializer(c.serializer.Code())
+	}
 	if err != nil {
+		cc.close(err)
 		return nil, err
 	}
+	cc.startKeepalive(c.heartbeatInterval, c.heartbeatTimeout)
+	return cc, nil
+}
 
-	if isOneway(ctx) {
-		return nil, errs.ErrIsOneway
+// openConn 建立连接并且开始读取响应
+func (c *Client) openConn(ctx context.Context) (*clientConn, error) {
+	conn, err := c.dial(ctxWithFrameLimits(ctx, c.maxHeaderSize, c.maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	fr := NewFrameReader(conn, c.maxHeaderSize, c.maxBodySize)
+	if c.writeTimeout > 0 {
+		conn = &writeTimeoutConn{Conn: conn, timeout: c.writeTimeout}
+	}
+	return newClientConn(conn, fr), nil
+}
+
+// proposedSerializers 返回握手的时候提议的序列化协议，默认的排在最前面。
+// 总是提议 JSON 和 Proto，单次调用可以通过 CallWithSerializer 换成它们
+func (c *Client) proposedSerializers() []uint8 {
+	res := []uint8{c.serializer.Code()}
+	for _, code := range []uint8{(&serialize.JsonSerializer{}).Code(), (&serialize.ProtoSerializer{}).Code()} {
+		if code != res[0] {
+			res = append(res, code)
+		}
+	}
+	return res
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := c.transport.Dial(ctx, c.addr)
+	config := c.tlsConfig
+	if c.certReloader != nil {
+		config = c.certReloader.ClientConfig(config)
+	}
+	if err != nil || config == nil {
+		return conn, err
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = c.addr
+		if host, _, er := net.SplitHostPort(c.addr); er == nil {
+			config.ServerName = host
+		}
+	}
+	tlsConn := tls.Client(conn, config)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// writeTimeoutConn 每次写之前设置写超时
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *writeTimeoutConn) Write(p []byte) (int, error) {
+	if err := c.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
 	}
-	return ReadMsg(conn)
+	return c.Conn.Write(p)
 }
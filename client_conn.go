@@ -0,0 +1,248 @@
+package go_rpc
+
+import (
+	"context"
+	"go-rpc/internal/errs"
+	"go-rpc/message"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clientConn 是一个可以多路复用的连接。
+// 多个请求可以同时写到同一个连接上，响应由 readLoop 按照 RequestId 分发给对应的调用者
+type clientConn struct {
+	conn net.Conn
+	fr   *FrameReader
+	fw   *FrameWriter
+
+	// 握手协商出来的结果，握手完成之后就不会再修改
+	version     uint8
+	features    uint8
+	serializers []uint8
+
+	// keepalive 在握手之后才设置，readLoop 会并发读取它
+	keepalive atomic.Pointer[keepalive]
+	// draining 表示服务端正在退出，新的请求不应该再使用这个连接，
+	// 已经发出去的请求还是会正常收到响应
+	draining atomic.Bool
+
+	// calls 是正在使用这个连接的调用数，lastUsed 是最后一次调用结束的时间，
+	// 它们由 Client 的 mutex 保护
+	calls    int
+	lastUsed time.Time
+
+	mutex   sync.Mutex
+	pending map[uint32]chan *message.Response
+	// pongs 是等待 pong 的 ping 调用者
+	pongs []chan struct{}
+	// onClose 在连接关闭之后调用
+	onClose func()
+	err     error
+	closed  chan struct{}
+}
+
+func newClientConn(conn net.Conn, fr *FrameReader) *clientConn {
+	cc := &clientConn{
+		conn:    conn,
+		fr:      fr,
+		fw:      NewFrameWriter(conn),
+		pending: make(map[uint32]chan *message.Response, 16),
+		closed:  make(chan struct{}),
+	}
+	go cc.readLoop()
+	return cc
+}
+
+func (cc *clientConn) send(ctx context.Context, req *message.Request) (*message.Response, error) {
+	oneway := isOneway(ctx)
+	var ch chan *message.Response
+	if !oneway {
+		ch = make(chan *message.Response, 1)
+		if err := cc.register(req.RequestId, ch); err != nil {
+			return nil, err
+		}
+		defer cc.unregister(req.RequestId)
+	}
+
+	if err := cc.fw.WriteFrame(req.Encode()); err != nil {
+		cc.close(err)
+		return nil, err
+	}
+
+	if oneway {
+		return nil, errs.ErrIsOneway
+	}
+
+	select {
+	case <-ctx.Done():
+		cc.cancelRequest(req)
+		return nil, ctx.Err()
+	case resp := <-ch:
+		return resp, nil
+	case <-cc.closed:
+		return nil, cc.err
+	}
+}
+
+// cancelRequest 通知服务端取消请求，让服务端不再浪费资源处理调用者已经放弃的请求。
+// 写 cancel 帧可能会被阻塞，所以不让调用者等待它
+func (cc *clientConn) cancelRequest(req *message.Request) {
+	if req.Version < message.Version3 {
+		return
+	}
+	go func() {
+		_ = cc.fw.WriteFrame(encodeControl(false, message.KindCancel, req.RequestId))
+	}()
+}
+
+func (cc *clientConn) register(id uint32, ch chan *message.Response) error {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if cc.err != nil {
+		return cc.err
+	}
+	cc.pending[id] = ch
+	return nil
+}
+
+func (cc *clientConn) unregister(id uint32) {
+	cc.mutex.Lock()
+	delete(cc.pending, id)
+	cc.mutex.Unlock()
+}
+
+func (cc *clientConn) readLoop() {
+	for {
+		bs, err := cc.fr.ReadFrame()
+		if err != nil {
+			cc.close(err)
+			return
+		}
+		if k := cc.keepalive.Load(); k != nil {
+			k.touch()
+		}
+		resp, err := message.DecodeRes(bs)
+		if err != nil {
+			cc.close(err)
+			return
+		}
+		switch resp.Kind {
+		case 0, message.KindResponse:
+		case message.KindPing:
+			go func() {
+				if er := cc.fw.WriteFrame(encodeControl(false, message.KindPong, 0)); er != nil {
+					cc.close(er)
+				}
+			}()
+			continue
+		case message.KindPong:
+			cc.mutex.Lock()
+			for _, ch := range cc.pongs {
+				close(ch)
+			}
+			cc.pongs = nil
+			cc.mutex.Unlock()
+			continue
+		case message.KindGoAway:
+			cc.draining.Store(true)
+			continue
+		default:
+			// 不认识的控制帧直接忽略
+			continue
+		}
+		cc.mutex.Lock()
+		ch, ok := cc.pending[resp.RequestId]
+		delete(cc.pending, resp.RequestId)
+		cc.mutex.Unlock()
+		// 调用者可能已经超时返回了，这时候直接丢弃响应
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+// ping 发送一个 ping 并且等待 pong，用来确认空闲的连接还能用。
+// 任何一个 ping 之后收到的 pong 都说明连接是好的
+func (cc *clientConn) ping(ctx context.Context) error {
+	ch := make(chan struct{})
+	cc.mutex.Lock()
+	if cc.err != nil {
+		cc.mutex.Unlock()
+		return cc.err
+	}
+	cc.pongs = append(cc.pongs, ch)
+	cc.mutex.Unlock()
+	if err := cc.fw.WriteFrame(encodeControl(false, message.KindPing, 0)); err != nil {
+		cc.close(err)
+		return err
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-cc.closed:
+		return cc.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startKeepalive 在握手协商出 Version3 之后开始发送心跳
+func (cc *clientConn) startKeepalive(interval, timeout time.Duration) {
+	if interval <= 0 || cc.version < message.Version3 {
+		return
+	}
+	cc.keepalive.Store(newKeepalive(interval, timeout, func() error {
+		return cc.fw.WriteFrame(encodeControl(false, message.KindPing, 0))
+	}, cc.close))
+	if cc.isClosed() {
+		cc.keepalive.Load().stop()
+	}
+}
+
+// isAvailable 判断新的请求能不能使用这个连接
+func (cc *clientConn) isAvailable() bool {
+	return !cc.isClosed() && !cc.draining.Load()
+}
+
+func (cc *clientConn) isClosed() bool {
+	select {
+	case <-cc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// setOnClose 设置连接关闭之后调用的 fn，已经关闭的时候马上调用
+func (cc *clientConn) setOnClose(fn func()) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.onClose = fn
+	if cc.err != nil {
+		go fn()
+	}
+}
+
+// close 关闭连接，并且让所有还在等待响应的调用者返回 err
+func (cc *clientConn) close(err error) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if cc.err != nil {
+		return
+	}
+	if err == nil {
+		err = errs.ErrConnClosed
+	}
+	cc.err = err
+	close(cc.closed)
+	if cc.onClose != nil {
+		// 调用者可能持有 Client 的锁，所以不能在这里直接调用
+		go cc.onClose()
+	}
+	if k := cc.keepalive.Load(); k != nil {
+		k.stop()
+	}
+	_ = cc.conn.Close()
+}
@@ -2,11 +2,19 @@ package go_rpc
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go-rpc/internal/errs"
+	"go-rpc/message"
 	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -15,13 +23,9 @@ func TestInitClientProxy(t *testing.T) {
 	server := NewServer()
 	service := &UserServiceServer{}
 	server.RegisterService(service)
-	go func() {
-		err := server.Start("tcp", ":8081")
-		t.Log(err)
-	}()
-	time.Sleep(time.Second * 3)
+	addr := startServer(t, server)
 	usClient := &UserService{}
-	client, err := NewClient(":8081")
+	client, err := NewClient(addr)
 	require.NoError(t, err)
 	err = client.InitService(usClient)
 	require.NoError(t, err)
@@ -80,14 +84,10 @@ func TestOneway(t *testing.T) {
 	server := NewServer()
 	service := &UserServiceServer{}
 	server.RegisterService(service)
-	go func() {
-		err := server.Start("tcp", ":8081")
-		t.Log(err)
-	}()
-	time.Sleep(time.Second * 3)
+	addr := startServer(t, server)
 
 	usClient := &UserService{}
-	client, err := NewClient(":8081")
+	client, err := NewClient(addr)
 	require.NoError(t, err)
 	err = client.InitService(usClient)
 	require.NoError(t, err)
@@ -124,14 +124,10 @@ func TestTimeout(t *testing.T) {
 	server := NewServer()
 	service := &UserServiceServerTimeout{t: t}
 	server.RegisterService(service)
-	go func() {
-		err := server.Start("tcp", ":8081")
-		t.Log(err)
-	}()
-	time.Sleep(time.Second * 3)
+	addr := startServer(t, server)
 
 	usClient := &UserService{}
-	client, err := NewClient(":8081")
+	client, err := NewClient(addr)
 	require.NoError(t, err)
 	err = client.InitService(usClient)
 	require.NoError(t, err)
@@ -150,7 +146,8 @@ func TestTimeout(t *testing.T) {
 				// 服务睡眠 2s
 				// 但是超时设置了一秒，所以客户端预期拿到一个超时响应
 				service.sleep = time.Second * 2
-				ctx, _ := context.WithTimeout(context.Background(), time.Second)
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				t.Cleanup(cancel)
 				return ctx
 			},
 			wantResp: &GetByIdResp{},
@@ -167,6 +164,150 @@ func TestTimeout(t *testing.T) {
 	}
 }
 
+func TestMultiplex(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServerSlow{})
+	addr := startServer(t, server)
+
+	usClient := &UserService{}
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	err = client.InitService(usClient)
+	require.NoError(t, err)
+
+	// 先发出去的请求睡得更久，所以响应是乱序回来的
+	var wg sync.WaitGroup
+	for i := 50; i > 0; i-- {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			resp, er := usClient.GetById(context.Background(), &GetByIdReq{Id: id})
+			assert.NoError(t, er)
+			assert.Equal(t, &GetByIdResp{Msg: strconv.Itoa(id)}, resp)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServerSlow{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	require.Eventually(t, func() bool {
+		return server.Addr() != nil
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, listener.Addr(), server.Addr())
+
+	usClient := &UserService{}
+	client, err := NewClient(server.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, client.InitService(usClient))
+
+	// 请求执行 300ms，Shutdown 要等它结束
+	respCh := make(chan error, 1)
+	go func() {
+		resp, er := usClient.GetById(context.Background(), &GetByIdReq{Id: 30})
+		if er == nil && resp.Msg != "30" {
+			er = errors.New("unexpected response " + resp.Msg)
+		}
+		respCh <- er
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	require.NoError(t, server.Shutdown(ctx))
+	assert.NoError(t, <-respCh)
+	assert.Equal(t, errs.ErrServerClosed, <-serveErr)
+
+	// 服务端已经通知客户端退出，新的请求不会再使用老的连接
+	_, err = usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+	assert.Error(t, err)
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServerSlow{})
+	addr := startServer(t, server)
+
+	usClient := &UserService{}
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	require.NoError(t, client.InitService(usClient))
+
+	respCh := make(chan error, 1)
+	go func() {
+		_, er := usClient.GetById(context.Background(), &GetByIdReq{Id: 100})
+		respCh <- er
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+	assert.Error(t, <-respCh)
+}
+
+func TestServer_AcceptTemporaryError(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener := &flakyListener{Listener: l}
+	listener.failures.Store(3)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	defer server.Close()
+
+	// 文件描述符用完这样的错误过去之后，服务端继续接收连接
+	client, err := NewClient(l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	usClient := &UserService{}
+	require.NoError(t, client.InitService(usClient))
+	resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", resp.Msg)
+	select {
+	case err = <-serveErr:
+		t.Fatalf("serve returned: %v", err)
+	default:
+	}
+}
+
+// flakyListener 的前 failures 次 Accept 返回 EMFILE
+type flakyListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, os.NewSyscallError("accept", syscall.EMFILE)
+	}
+	return l.Listener.Accept()
+}
+
+// startServer 在随机端口上启动服务端，测试结束的时候关闭它
+func startServer(t *testing.T, server *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	return listener.Addr().String()
+}
+
 type UserService struct {
 	GetById func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
 }
@@ -220,3 +361,61 @@ func (u *UserServiceServerTimeout) GetById(ctx context.Context, req *GetByIdReq)
 func (u *UserServiceServerTimeout) Name() string {
 	return "user-service"
 }
+
+type UserServiceServerSlow struct {
+}
+
+func (u *UserServiceServerSlow) GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	time.Sleep(time.Duration(req.Id) * time.Millisecond * 10)
+	return &GetByIdResp{
+		Msg: strconv.Itoa(req.Id),
+	}, nil
+}
+
+func (u *UserServiceServerSlow) Name() string {
+	return "user-service"
+}
+
+func TestMalformedRequest(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+	cConn, sConn := net.Pipe()
+	go func() {
+		_ = server.handleConn(sConn)
+	}()
+	defer cConn.Close()
+
+	// 服务名后面缺少 '\n'
+	data := make([]byte, minHeadLength+3)
+	binary.BigEndian.PutUint32(data[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(data[8:12], 7)
+	copy(data[minHeadLength:], "abc")
+	fw := NewFrameWriter(cConn)
+	fr := NewFrameReader(cConn, DefaultMaxHeaderSize, DefaultMaxBodySize)
+	require.NoError(t, fw.WriteFrame(data))
+
+	bs, err := fr.ReadFrame()
+	require.NoError(t, err)
+	resp, err := message.DecodeRes(bs)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), resp.RequestId)
+	assert.Contains(t, string(resp.Error), errs.ErrMalformedMessage.Error())
+
+	// 连接没有被关闭，后面的请求还可以正常处理
+	req := &message.Request{
+		RequestId:   8,
+		ServiceName: "user-service",
+		MethodName:  "GetById",
+		Serializer:  1,
+		Data:        []byte(`{"Id":123}`),
+	}
+	req.CalculateHeaderLength()
+	req.CalculateBodyLength()
+	require.NoError(t, fw.WriteFrame(req.Encode()))
+	bs, err = fr.ReadFrame()
+	require.NoError(t, err)
+	resp, err = message.DecodeRes(bs)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(8), resp.RequestId)
+	assert.Equal(t, `{"Msg":"hello, world"}`, string(resp.Data))
+}
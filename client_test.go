@@ -0,0 +1,385 @@
+package go_rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-rpc/compress"
+	"go-rpc/internal/errs"
+	"go-rpc/message"
+	"go-rpc/serialize"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_Pool(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServerSlow{})
+	addr := startServer(t, server)
+
+	testCases := []struct {
+		name  string
+		opts  []ClientOption
+		calls int
+		// 调用结束之后连接池里面剩下的连接数
+		wantIdle int
+	}{
+		{
+			name:     "default",
+			calls:    10,
+			wantIdle: 1,
+		},
+		{
+			name:     "grow",
+			opts:     []ClientOption{ClientWithPool(1, 4, 4, 0)},
+			calls:    10,
+			wantIdle: 4,
+		},
+		{
+			name:     "max idle",
+			opts:     []ClientOption{ClientWithPool(3, 3, 1, 0)},
+			calls:    1,
+			wantIdle: 1,
+		},
+		{
+			name:     "idle timeout",
+			opts:     []ClientOption{ClientWithPool(3, 3, 3, time.Millisecond)},
+			calls:    1,
+			wantIdle: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := NewClient(addr, tc.opts...)
+			require.NoError(t, err)
+			defer client.Close()
+			usClient := &UserService{}
+			require.NoError(t, client.InitService(usClient))
+
+			var wg sync.WaitGroup
+			time.Sleep(time.Millisecond * 5)
+			for i := 0; i < tc.calls; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, er := usClient.GetById(context.Background(), &GetByIdReq{Id: 10})
+					assert.NoError(t, er)
+				}()
+			}
+			wg.Wait()
+
+			// 下一次取连接的时候清理空闲的连接
+			cc, err := client.getConn(context.Background(), false)
+			require.NoError(t, err)
+			client.putConn(cc)
+			client.mutex.Lock()
+			defer client.mutex.Unlock()
+			assert.Equal(t, tc.wantIdle, len(client.conns))
+		})
+	}
+}
+
+func TestClient_DrainingConn(t *testing.T) {
+	newConn := func(calls int) *clientConn {
+		cConn, sConn := net.Pipe()
+		t.Cleanup(func() {
+			_ = sConn.Close()
+		})
+		cc := newClientConn(cConn, NewFrameReader(cConn, DefaultMaxHeaderSize, DefaultMaxBodySize))
+		// 服务端发送了 goaway，但是还没有关闭连接
+		cc.draining.Store(true)
+		cc.calls = calls
+		return cc
+	}
+	client := &Client{maxCap: 1, maxIdle: 1, done: make(chan struct{}), stateCh: make(chan struct{})}
+	idle, busy, closing := newConn(0), newConn(1), newConn(1)
+	client.conns = []*clientConn{idle, busy, closing}
+
+	client.mutex.Lock()
+	assert.Nil(t, client.pickLocked())
+	conns := slices.Clone(client.conns)
+	client.mutex.Unlock()
+	// 没有调用的连接马上关闭，还有调用的连接留在连接池里面
+	assert.True(t, idle.isClosed())
+	assert.Equal(t, []*clientConn{busy, closing}, conns)
+
+	// 最后一个调用结束之后关闭
+	client.putConn(busy)
+	assert.True(t, busy.isClosed())
+
+	// Client.Close 也能关闭还有调用的连接
+	require.NoError(t, client.Close())
+	assert.True(t, closing.isClosed())
+}
+
+func TestClient_Compressor(t *testing.T) {
+	testCases := []struct {
+		name       string
+		service    *UserServiceServer
+		compressor compress.Compressor
+		wantResp   *GetByIdResp
+		wantErr    string
+	}{
+		{
+			name:       "gzip",
+			service:    &UserServiceServer{Msg: strings.Repeat("go-rpc", 100)},
+			compressor: &compress.GzipCompressor{},
+			wantResp:   &GetByIdResp{Msg: strings.Repeat("go-rpc", 100)},
+		},
+		{
+			// 响应有数据的时候也要保留方法返回的 error
+			name:       "method error",
+			service:    &UserServiceServer{Err: errors.New("mock error")},
+			compressor: &compress.GzipCompressor{},
+			wantErr:    "mock error",
+		},
+		{
+			name:       "not supported",
+			service:    &UserServiceServer{},
+			compressor: unknownCompressor{},
+			wantErr:    errs.ErrCompressorNotSupported.Error(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer()
+			server.RegisterService(tc.service)
+			addr := startServer(t, server)
+			client, err := NewClient(addr, ClientWithCompressor(tc.compressor))
+			require.NoError(t, err)
+			defer client.Close()
+			usClient := &UserService{}
+			require.NoError(t, client.InitService(usClient))
+			resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantResp, resp)
+		})
+	}
+}
+
+func TestServer_DecompressLimit(t *testing.T) {
+	server := NewServer(ServerWithFrameLimits(DefaultMaxHeaderSize, 4096))
+	server.RegisterService(&UserServiceServer{})
+	addr := startServer(t, server)
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// 压缩之后没有超过限制，解压之后超过了
+	data, err := (&compress.GzipCompressor{}).Compress(make([]byte, 1<<20))
+	require.NoError(t, err)
+	require.Less(t, len(data), 4096)
+	resp, err := client.Invoke(context.Background(), &message.Request{
+		ServiceName: "user-service",
+		MethodName:  "GetById",
+		Data:        data,
+		Serializer:  (&serialize.JsonSerializer{}).Code(),
+		Compresser:  (&compress.GzipCompressor{}).Code(),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, errs.ErrInvalidArgument.Error()+": "+errs.ErrFrameTooLarge.Error(), string(resp.Error))
+}
+
+func TestCallOptions(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServerMeta{})
+	server.RegisterService(&GreeterServer{})
+	addr := startServer(t, server)
+
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	defer client.Close()
+	usClient := &UserService{}
+	require.NoError(t, client.InitService(usClient))
+	greeter := &Greeter{}
+	require.NoError(t, client.InitService(greeter))
+
+	t.Run("metadata", func(t *testing.T) {
+		ctx := CtxWithCallOptions(context.Background(), CallWithMetadata(map[string]string{"trace-id": "1"}))
+		ctx = CtxWithCallOptions(ctx, CallWithMetadata(map[string]string{"user": "tom"}))
+		resp, er := usClient.GetById(ctx, &GetByIdReq{})
+		require.NoError(t, er)
+		assert.Equal(t, "1,tom", resp.Msg)
+	})
+
+	t.Run("reserved metadata", func(t *testing.T) {
+		// 框架自己使用的字段被忽略，不会把调用变成 oneway
+		ctx := CtxWithCallOptions(context.Background(),
+			CallWithMetadata(map[string]string{"trace-id": "1", "user": "tom", "one-way": "true"}),
+			CallWithTimeout(time.Second))
+		resp, er := usClient.GetById(ctx, &GetByIdReq{})
+		require.NoError(t, er)
+		assert.Equal(t, "1,tom", resp.Msg)
+	})
+
+	t.Run("serializer", func(t *testing.T) {
+		ctx := CtxWithCallOptions(context.Background(), CallWithSerializer(&serialize.ProtoSerializer{}))
+		resp, er := greeter.SayHello(ctx, wrapperspb.Int64(0))
+		require.NoError(t, er)
+		assert.Equal(t, "hello", resp.GetValue())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		ctx := CtxWithCallOptions(context.Background(),
+			CallWithSerializer(&serialize.ProtoSerializer{}), CallWithTimeout(time.Millisecond*50))
+		_, er := greeter.SayHello(ctx, wrapperspb.Int64(1000))
+		assert.ErrorContains(t, er, "deadline exceeded")
+	})
+}
+
+func TestClient_Close(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServerSlow{})
+	addr := startServer(t, server)
+
+	client, err := NewClient(addr, ClientWithPool(2, 2, 2, 0))
+	require.NoError(t, err)
+	usClient := &UserService{}
+	require.NoError(t, client.InitService(usClient))
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, er := usClient.GetById(context.Background(), &GetByIdReq{Id: 100})
+		errCh <- er
+	}()
+	time.Sleep(time.Millisecond * 100)
+	require.NoError(t, client.Close())
+	// 正在等待响应的调用和之后的调用都会失败
+	assert.Equal(t, errs.ErrClientClosed, <-errCh)
+	_, err = usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+	assert.Equal(t, errs.ErrClientClosed, err)
+}
+
+// UserServiceServerMeta 把客户端传过来的元数据放在响应里面
+type UserServiceServerMeta struct{}
+
+func (u *UserServiceServerMeta) GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	md := MetadataFromContext(ctx)
+	return &GetByIdResp{Msg: md["trace-id"] + "," + md["user"]}, nil
+}
+
+func (u *UserServiceServerMeta) Name() string {
+	return "user-service"
+}
+
+type unknownCompressor struct{}
+
+func (unknownCompressor) Code() uint8 {
+	return 99
+}
+
+func (unknownCompressor) Compress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (unknownCompressor) Decompress(data []byte, maxSize uint32) ([]byte, error) {
+	return data, nil
+}
+
+func TestClient_HealthCheck(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "go-rpc"})
+	addr := startServer(t, server)
+
+	transport := &freezeTransport{}
+	client, err := NewClient(addr, ClientWithTransport(transport),
+		ClientWithHealthCheck(time.Millisecond*10), ClientWithDialTimeout(time.Millisecond*200))
+	require.NoError(t, err)
+	defer client.Close()
+	usClient := &UserService{}
+	require.NoError(t, client.InitService(usClient))
+
+	// 连接没有断开，但是写出去的数据都丢掉了，检查的时候收不到 pong
+	transport.conns[0].frozen.Store(true)
+	time.Sleep(time.Millisecond * 20)
+	resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "go-rpc", resp.Msg)
+	assert.Equal(t, 2, len(transport.conns))
+	assert.Equal(t, ClientStats{Open: 1, Idle: 1}, client.Stats())
+}
+
+func TestClient_DialBackoff(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "go-rpc"})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	go func() {
+		_ = server.Serve(l)
+	}()
+
+	client, err := NewClient(addr, ClientWithDialBackoff(time.Millisecond*200, time.Second))
+	require.NoError(t, err)
+	defer client.Close()
+	usClient := &UserService{}
+	require.NoError(t, client.InitService(usClient))
+
+	require.NoError(t, server.Close())
+	require.Eventually(t, func() bool {
+		return client.State() == StateIdle
+	}, time.Second, time.Millisecond*10)
+
+	// 第一次建立连接失败之后，退避期间不会再尝试
+	_, err = usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+	assert.Error(t, err)
+	_, err = usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+	assert.Error(t, err)
+	assert.Equal(t, uint64(1), client.Stats().DialFailures)
+
+	// 服务端恢复之后，退避结束就可以重新建立连接
+	l, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	server = NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "go-rpc"})
+	go func() {
+		_ = server.Serve(l)
+	}()
+	defer server.Close()
+	require.Eventually(t, func() bool {
+		_, er := usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+		return er == nil
+	}, time.Second*2, time.Millisecond*50)
+	assert.Equal(t, ClientStats{Open: 1, Idle: 1, DialFailures: 1}, client.Stats())
+}
+
+// freezeTransport 记录建立的连接，测试可以让连接静默地丢掉写出去的数据
+type freezeTransport struct {
+	TCPTransport
+	conns []*freezeConn
+}
+
+func (f *freezeTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := f.TCPTransport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	fc := &freezeConn{Conn: conn}
+	f.conns = append(f.conns, fc)
+	return fc, nil
+}
+
+type freezeConn struct {
+	net.Conn
+	frozen atomic.Bool
+}
+
+func (c *freezeConn) Write(p []byte) (int, error) {
+	if c.frozen.Load() {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,44 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"go-rpc/internal/errs"
+	"io"
+)
+
+type GzipCompressor struct {
+}
+
+func (c *GzipCompressor) Code() uint8 {
+	return 1
+}
+
+func (c *GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *GzipCompressor) Decompress(data []byte, maxSize uint32) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// 多读一个字节，用来判断有没有超过 maxSize
+	res, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(res) > int(maxSize) {
+		return nil, errs.ErrFrameTooLarge
+	}
+	return res, nil
+}
@@ -0,0 +1,33 @@
+package compress
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-rpc/internal/errs"
+	"testing"
+)
+
+func TestGzipCompressor(t *testing.T) {
+	testCases := []struct {
+		name    string
+		data    []byte
+		maxSize uint32
+		wantErr error
+	}{
+		{name: "empty", data: []byte{}, maxSize: 10},
+		{name: "equal to max size", data: []byte("hello"), maxSize: 5},
+		{name: "too large", data: make([]byte, 1<<20), maxSize: 1024, wantErr: errs.ErrFrameTooLarge},
+	}
+	c := &GzipCompressor{}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			compressed, err := c.Compress(tc.data)
+			require.NoError(t, err)
+			data, err := c.Decompress(compressed, tc.maxSize)
+			assert.Equal(t, tc.wantErr, err)
+			if err == nil {
+				assert.Equal(t, tc.data, data)
+			}
+		})
+	}
+}
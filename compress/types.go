@@ -0,0 +1,10 @@
+package compress
+
+type Compressor interface {
+	// Code 是写在请求和响应里面的压缩算法编号，0 表示没有压缩
+	Code() uint8
+	Compress(data []byte) ([]byte, error)
+	// Decompress 解压 data，解压之后超过 maxSize 字节的时候返回 errs.ErrFrameTooLarge，
+	// 避免很小的数据解压出非常大的内容
+	Decompress(data []byte, maxSize uint32) ([]byte, error)
+}
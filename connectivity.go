@@ -0,0 +1,196 @@
+package go_rpc
+
+import (
+	"context"
+	"go-rpc/internal/errs"
+	"time"
+)
+
+// ConnState 是客户端的连接状态
+type ConnState int
+
+const (
+	// StateIdle 表示没有可用的连接，也没有在建立连接，下一次调用的时候才会建立
+	StateIdle ConnState = iota
+	// StateConnecting 表示正在建立连接
+	StateConnecting
+	// StateReady 表示至少有一个可用的连接
+	StateReady
+	// StateTransientFailure 表示建立连接失败了，正在等待退避时间结束
+	StateTransientFailure
+	// StateShutdown 表示客户端已经关闭
+	StateShutdown
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateIdle:
+		return "IDLE"
+	case StateConnecting:
+		return "CONNECTING"
+	case StateReady:
+		return "READY"
+	case StateTransientFailure:
+		return "TRANSIENT_FAILURE"
+	case StateShutdown:
+		return "SHUTDOWN"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// State 返回客户端当前的连接状态
+func (c *Client) State() ConnState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state
+}
+
+// WaitForStateChange 等待状态从 source 变成别的状态。
+// 状态已经不是 source 的时候马上返回 true，ctx 结束的时候返回 false
+func (c *Client) WaitForStateChange(ctx context.Context, source ConnState) bool {
+	for {
+		c.mutex.Lock()
+		state, ch := c.state, c.stateCh
+		c.mutex.Unlock()
+		if state != source {
+			return true
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// updateStateLocked 根据连接池重新计算状态，状态变化的时候通知等待的调用者。调用者必须持有 mutex
+func (c *Client) updateStateLocked() {
+	state := StateIdle
+	switch {
+	case c.closed:
+		state = StateShutdown
+	case c.hasAvailableLocked():
+		state = StateReady
+	case c.dialing > 0:
+		state = StateConnecting
+	case c.dialErr != nil:
+		state = StateTransientFailure
+	}
+	if state == c.state {
+		return
+	}
+	c.state = state
+	close(c.stateCh)
+	c.stateCh = make(chan struct{})
+}
+
+func (c *Client) hasAvailableLocked() bool {
+	for _, cc := range c.conns {
+		if cc.isAvailable() {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForRetry 在拿不到连接的时候等待，直到状态变化或者退避时间结束
+func (c *Client) waitForRetry(ctx context.Context) error {
+	c.mutex.Lock()
+	state, ch, backoff := c.state, c.stateCh, time.Until(c.nextDial)
+	c.mutex.Unlock()
+	var retry <-chan time.Time
+	switch state {
+	case StateShutdown:
+		return errs.ErrClientClosed
+	case StateConnecting:
+		// 等待正在建立的连接
+	case StateTransientFailure:
+		if backoff <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(backoff)
+		defer timer.Stop()
+		retry = timer.C
+	default:
+		// 状态在 acquire 之后已经变了，马上重试
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ch:
+	case <-retry:
+	}
+	return nil
+}
+
+// startConnectLocked 在后台建立连接，已经在建立的时候什么也不做。调用者必须持有 mutex。
+// 后台的这次建立连接马上算进 dialing，返回的时候状态已经是 StateConnecting，acquire 也不会再同时建立一个
+func (c *Client) startConnectLocked() {
+	if c.connecting || c.closed {
+		return
+	}
+	c.connecting = true
+	c.dialing++
+	c.updateStateLocked()
+	go c.connect()
+}
+
+// connect 在后台建立连接，直到连接池里面有 initialCap 个可用的连接。
+// 失败的时候等待退避时间之后重试，等待的时候不算进 dialing
+func (c *Client) connect() {
+	c.mutex.Lock()
+	for {
+		c.pickLocked()
+		if c.closed || len(c.conns) >= c.initialConns() {
+			c.dialing--
+			c.connecting = false
+			c.updateStateLocked()
+			c.mutex.Unlock()
+			return
+		}
+		if backoff := time.Until(c.nextDial); backoff > 0 {
+			c.dialing--
+			c.updateStateLocked()
+			c.mutex.Unlock()
+			select {
+			case <-time.After(backoff):
+			case <-c.done:
+				c.mutex.Lock()
+				c.connecting = false
+				c.mutex.Unlock()
+				return
+			}
+			c.mutex.Lock()
+			c.dialing++
+			c.updateStateLocked()
+			continue
+		}
+		c.mutex.Unlock()
+
+		cc, err := c.newConn()
+		c.mutex.Lock()
+		c.recordDialLocked(err)
+		if err == nil {
+			if c.closed {
+				cc.close(errs.ErrClientClosed)
+			} else {
+				c.addConnLocked(cc)
+			}
+		}
+		c.updateStateLocked()
+	}
+}
+
+// connLost 在连接断开之后清理连接池。
+// ClientWithNonBlocking 的时候，所有的连接都断开了就在后台重新建立连接
+func (c *Client) connLost() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pickLocked()
+	if c.nonBlocking && len(c.conns) == 0 {
+		c.startConnectLocked()
+	}
+	c.updateStateLocked()
+}
@@ -0,0 +1,135 @@
+package go_rpc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_NonBlocking(t *testing.T) {
+	// 先拿到一个端口，服务端晚一点才启动
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	client, err := NewClient(addr, ClientWithNonBlocking(),
+		ClientWithDialBackoff(time.Millisecond*20, time.Millisecond*100))
+	require.NoError(t, err)
+	usClient := &UserService{}
+	require.NoError(t, client.InitService(usClient))
+
+	var (
+		mutex  sync.Mutex
+		states []ConnState
+	)
+	watchCtx, cancelWatch := context.WithCancel(context.Background())
+	defer cancelWatch()
+	go func() {
+		for state := StateIdle; client.WaitForStateChange(watchCtx, state); {
+			state = client.State()
+			mutex.Lock()
+			states = append(states, state)
+			mutex.Unlock()
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		return client.State() == StateTransientFailure
+	}, time.Second, time.Millisecond*5)
+
+	// fail fast 的调用马上返回错误，等待的调用直到 ctx 结束
+	_, err = usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+	assert.Error(t, err)
+	ctx, cancel := context.WithTimeout(CtxWithCallOptions(context.Background(), CallWithWaitForReady(true)), time.Millisecond*50)
+	_, err = usClient.GetById(ctx, &GetByIdReq{Id: 1})
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "go-rpc"})
+	respCh := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(CtxWithCallOptions(context.Background(), CallWithWaitForReady(true)), time.Second*2)
+		defer cancel()
+		_, er := usClient.GetById(ctx, &GetByIdReq{Id: 1})
+		respCh <- er
+	}()
+	time.Sleep(time.Millisecond * 50)
+	l, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	go func() {
+		_ = server.Serve(l)
+	}()
+	assert.NoError(t, <-respCh)
+	assert.Equal(t, StateReady, client.State())
+
+	// 连接断开之后在后台重新建立连接
+	require.NoError(t, server.Close())
+	require.Eventually(t, func() bool {
+		return client.State() != StateReady
+	}, time.Second, time.Millisecond*5)
+	server = NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "go-rpc"})
+	l, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	go func() {
+		_ = server.Serve(l)
+	}()
+	defer server.Close()
+	require.Eventually(t, func() bool {
+		return client.State() == StateReady
+	}, time.Second*2, time.Millisecond*5)
+
+	require.NoError(t, client.Close())
+	assert.Equal(t, StateShutdown, client.State())
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	assert.False(t, client.WaitForStateChange(ctx, StateShutdown))
+
+	cancelWatch()
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Contains(t, states, StateConnecting)
+	assert.Contains(t, states, StateTransientFailure)
+	assert.Contains(t, states, StateReady)
+}
+
+func TestClient_FailFastWhileConnecting(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "go-rpc"})
+	addr := startServer(t, server)
+
+	transport := &slowDialTransport{delay: time.Millisecond * 100}
+	client, err := NewClient(addr, ClientWithNonBlocking(), ClientWithTransport(transport))
+	require.NoError(t, err)
+	defer client.Close()
+	usClient := &UserService{}
+	require.NoError(t, client.InitService(usClient))
+	assert.Equal(t, StateConnecting, client.State())
+
+	// 后台还在建立连接，fail fast 的调用等待它的结果，而不是马上失败
+	resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "go-rpc", resp.Msg)
+	// 调用等待的是后台的那次建立连接，没有再建立一个
+	assert.Equal(t, int32(1), transport.dials.Load())
+}
+
+// slowDialTransport 建立连接之前先等待 delay，dials 记录建立连接的次数
+type slowDialTransport struct {
+	TCPTransport
+	delay time.Duration
+	dials atomic.Int32
+}
+
+func (s *slowDialTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	s.dials.Add(1)
+	time.Sleep(s.delay)
+	return s.TCPTransport.Dial(ctx, addr)
+}
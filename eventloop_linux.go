@@ -0,0 +1,302 @@
+//go:build linux
+
+package go_rpc
+
+import (
+	"go-rpc/internal/errs"
+	"golang.org/x/sys/unix"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// eventLoopReadSize 是每次从连接读取的最大字节数，每个 loop 共用一个读缓冲
+const eventLoopReadSize = 64 << 10
+
+// eventLoops 是一组 event loop，新的连接轮流分配给它们
+type eventLoops struct {
+	loops []*eventLoop
+	next  atomic.Uint32
+}
+
+func newEventLoops(n int) (*eventLoops, error) {
+	ls := &eventLoops{}
+	for i := 0; i < n; i++ {
+		l, err := newEventLoop()
+		if err != nil {
+			ls.close()
+			return nil, err
+		}
+		ls.loops = append(ls.loops, l)
+		go l.run()
+	}
+	return ls, nil
+}
+
+// wrap 把连接包装成交给 event loop 的连接。
+// 不能直接读取 fd 的连接，例如 TLS 连接，返回 nil
+func (ls *eventLoops) wrap(conn net.Conn) *loopConn {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sysConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	fd := -1
+	if err = raw.Control(func(f uintptr) {
+		fd = int(f)
+	}); err != nil {
+		return nil
+	}
+	l := ls.loops[ls.next.Add(1)%uint32(len(ls.loops))]
+	return &loopConn{Conn: conn, raw: raw, fd: fd, loop: l}
+}
+
+func (ls *eventLoops) close() {
+	for _, l := range ls.loops {
+		l.close()
+	}
+}
+
+// eventLoop 用 epoll 等待多个连接，只读取可读的连接
+type eventLoop struct {
+	epfd int
+	// wakefd 用来通知 loop 退出
+	wakefd int
+	buf    []byte
+
+	mutex  sync.Mutex
+	conns  map[int]*loopConn
+	closed bool
+}
+
+func newEventLoop() (*eventLoop, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	wakefd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		_ = unix.Close(epfd)
+		return nil, err
+	}
+	if err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, wakefd, &unix.EpollEvent{
+		Events: unix.EPOLLIN,
+		Fd:     int32(wakefd),
+	}); err != nil {
+		_ = unix.Close(epfd)
+		_ = unix.Close(wakefd)
+		return nil, err
+	}
+	return &eventLoop{
+		epfd:   epfd,
+		wakefd: wakefd,
+		buf:    make([]byte, eventLoopReadSize),
+		conns:  make(map[int]*loopConn, 64),
+	}, nil
+}
+
+func (l *eventLoop) run() {
+	events := make([]unix.EpollEvent, 128)
+	for {
+		n, err := unix.EpollWait(l.epfd, events, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			// epoll 已经不能用了，留在 loop 里面的连接再也不会被读取，全部关闭
+			l.release()
+			l.closeConns()
+			return
+		}
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == l.wakefd {
+				l.release()
+				return
+			}
+			l.mutex.Lock()
+			c := l.conns[fd]
+			l.mutex.Unlock()
+			if c != nil {
+				c.readFrames(l.buf)
+			}
+		}
+	}
+}
+
+func (l *eventLoop) add(c *loopConn) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return net.ErrClosed
+	}
+	// 水平触发，没有读完的数据下一次 EpollWait 还会通知
+	if err := unix.EpollCtl(l.epfd, unix.EPOLL_CTL_ADD, c.fd, &unix.EpollEvent{
+		Events: unix.EPOLLIN | unix.EPOLLRDHUP,
+		Fd:     int32(c.fd),
+	}); err != nil {
+		return err
+	}
+	l.conns[c.fd] = c
+	return nil
+}
+
+// remove 必须在 fd 关闭之前调用，关闭之后 fd 可能已经被新的连接复用了
+func (l *eventLoop) remove(c *loopConn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conns[c.fd] != c {
+		return
+	}
+	delete(l.conns, c.fd)
+	if !l.closed {
+		_ = unix.EpollCtl(l.epfd, unix.EPOLL_CTL_DEL, c.fd, nil)
+	}
+}
+
+// close 通知 loop 退出，fd 由 loop 自己关闭，避免关闭之后被复用。
+// loop 已经退出的时候 wakefd 已经关闭了，不能再写
+func (l *eventLoop) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+	var buf [8]byte
+	buf[0] = 1
+	_, _ = unix.Write(l.wakefd, buf[:])
+}
+
+func (l *eventLoop) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	_ = unix.Close(l.epfd)
+	_ = unix.Close(l.wakefd)
+}
+
+// closeConns 关闭 loop 里面所有的连接。Close 会把连接从 conns 里面删除，所以先复制一份
+func (l *eventLoop) closeConns() {
+	l.mutex.Lock()
+	conns := make([]*loopConn, 0, len(l.conns))
+	for _, c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mutex.Unlock()
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
+
+// loopConn 是交给 event loop 的连接。
+// 所有关闭连接的地方最终都会调用 Close，它负责把连接从 loop 里面移除并且释放资源
+type loopConn struct {
+	net.Conn
+	raw  syscall.RawConn
+	fd   int
+	loop *eventLoop
+
+	s  *Server
+	sc *serverConn
+	// pending 是还不够一个帧的数据，空闲的连接不占用缓冲
+	pending []byte
+
+	// mutex 保证连接不会在加入 loop 的过程中被关闭
+	mutex  sync.Mutex
+	closed bool
+}
+
+// start 记录连接并且把它交给 event loop
+func (c *loopConn) start(s *Server, sc *serverConn) error {
+	c.s = s
+	c.sc = sc
+	if !s.trackConn(sc) {
+		return errs.ErrServerClosed
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if err := c.loop.add(c); err != nil {
+		c.closeLocked()
+		return err
+	}
+	return nil
+}
+
+// readFrames 在 loop 里面调用，读取一次数据并且处理其中完整的帧
+func (c *loopConn) readFrames(buf []byte) {
+	var (
+		n   int
+		err error
+	)
+	// RawConn.Read 保证读的时候 fd 不会被关闭
+	if er := c.raw.Read(func(fd uintptr) bool {
+		n, err = syscall.Read(int(fd), buf)
+		return true
+	}); er != nil {
+		_ = c.Close()
+		return
+	}
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return
+	}
+	if err != nil || n <= 0 {
+		_ = c.Close()
+		return
+	}
+
+	data := buf[:n]
+	if len(c.pending) > 0 {
+		c.pending = append(c.pending, data...)
+		data = c.pending
+	}
+	for {
+		frame, er := splitFrame(data, c.s.maxHeaderSize, c.s.maxBodySize)
+		if er != nil {
+			_ = c.Close()
+			return
+		}
+		if frame == nil {
+			break
+		}
+		data = data[len(frame):]
+		// 读缓冲会被复用，解析出来的请求不能引用它
+		if er = c.s.handleFrame(c.sc, append([]byte(nil), frame...)); er != nil {
+			_ = c.Close()
+			return
+		}
+	}
+	if len(data) == 0 {
+		c.pending = nil
+		return
+	}
+	c.pending = append(c.pending[:0], data...)
+}
+
+func (c *loopConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closeLocked()
+	return c.Conn.Close()
+}
+
+func (c *loopConn) closeLocked() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.loop.remove(c)
+	if c.sc != nil {
+		// Close 可能在持有 Server.mutex 的时候被调用
+		go c.s.releaseConn(c.sc)
+	}
+}
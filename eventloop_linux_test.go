@@ -0,0 +1,232 @@
+//go:build linux
+
+package go_rpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-rpc/message"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestEventLoop(t *testing.T) {
+	server := NewServer(ServerWithEventLoop(2))
+	server.RegisterService(&UserServiceServerSlow{})
+	addr := startServer(t, server)
+
+	t.Run("idle conns", func(t *testing.T) {
+		before := runtime.NumGoroutine()
+		conns := make([]net.Conn, 0, 200)
+		defer func() {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+		}()
+		for i := 0; i < 200; i++ {
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			conns = append(conns, conn)
+		}
+		require.Eventually(t, func() bool {
+			server.mutex.Lock()
+			defer server.mutex.Unlock()
+			return len(server.conns) >= 200
+		}, time.Second*5, time.Millisecond*10)
+		// 空闲的连接不占用 goroutine
+		assert.Eventually(t, func() bool {
+			return runtime.NumGoroutine()-before < 20
+		}, time.Second*5, time.Millisecond*10)
+	})
+
+	t.Run("multiplex", func(t *testing.T) {
+		usClient := &UserService{}
+		client, err := NewClient(addr)
+		require.NoError(t, err)
+		require.NoError(t, client.InitService(usClient))
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				resp, er := usClient.GetById(context.Background(), &GetByIdReq{Id: id % 4})
+				if assert.NoError(t, er) {
+					assert.Equal(t, strconv.Itoa(id%4), resp.Msg)
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	t.Run("frame larger than read buffer", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		cc := newClientConn(conn, NewFrameReader(conn, DefaultMaxHeaderSize, DefaultMaxBodySize))
+		defer cc.close(nil)
+		require.NoError(t, cc.handshake(context.Background(), 1, []uint8{1}))
+		req := newGetByIdReq(2, cc.version)
+		req.Data = []byte(fmt.Sprintf(`{"Id":1,"Padding":%q}`, strings.Repeat("a", eventLoopReadSize*3)))
+		req.CalculateBodyLength()
+		resp, err := cc.send(context.Background(), req)
+		require.NoError(t, err)
+		assert.Empty(t, resp.Error)
+		assert.Equal(t, `{"Msg":"1"}`, string(resp.Data))
+	})
+
+	t.Run("malformed frame", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		bs := make([]byte, 16)
+		bs[0] = byte(message.MagicNumber >> 8)
+		_, err = conn.Write(bs)
+		require.NoError(t, err)
+		// 魔数不对，服务端直接关闭连接
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(bs)
+		assert.Error(t, err)
+	})
+}
+
+func TestEventLoop_ConnMemory(t *testing.T) {
+	cConn, sConn := tcpPair(t)
+	defer cConn.Close()
+	defer sConn.Close()
+	c := (&eventLoops{loops: []*eventLoop{{}}}).wrap(sConn)
+	require.NotNil(t, c)
+	peer := &Peer{}
+
+	const n = 100
+	conns := make([]*serverConn, 0, n)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < n; i++ {
+		conns = append(conns, newServerConn(c, peer))
+	}
+	runtime.ReadMemStats(&after)
+	// 交给 event loop 的连接大部分时间都是空闲的，不应该一开始就分配写缓冲和请求表
+	perConn := (after.TotalAlloc - before.TotalAlloc) / n
+	assert.Less(t, perConn, uint64(1024), "%d bytes per connection", perConn)
+	for _, sc := range conns {
+		sc.cancel()
+	}
+}
+
+func TestEventLoop_Shutdown(t *testing.T) {
+	server := NewServer(ServerWithEventLoop(1))
+	server.RegisterService(&UserServiceServerSlow{})
+	addr := startServer(t, server)
+
+	usClient := &UserService{}
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	require.NoError(t, client.InitService(usClient))
+
+	respCh := make(chan error, 1)
+	go func() {
+		_, er := usClient.GetById(context.Background(), &GetByIdReq{Id: 20})
+		respCh <- er
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	loops := server.loops
+	require.NoError(t, server.Shutdown(ctx))
+	assert.NoError(t, <-respCh)
+	server.mutex.Lock()
+	assert.Empty(t, server.conns)
+	// 之后的 Close 不会再通知已经退出的 loop
+	assert.Nil(t, server.loops)
+	server.mutex.Unlock()
+	require.Eventually(t, func() bool {
+		l := loops.loops[0]
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		return l.closed
+	}, time.Second, time.Millisecond*10)
+	loops.close()
+}
+
+func TestEventLoop_EpollError(t *testing.T) {
+	l, err := newEventLoop()
+	require.NoError(t, err)
+	ls := &eventLoops{loops: []*eventLoop{l}}
+	cConn, sConn := tcpPair(t)
+	defer cConn.Close()
+	c := ls.wrap(sConn)
+	require.NotNil(t, c)
+	require.NoError(t, c.start(NewServer(), newServerConn(c, &Peer{})))
+
+	// EpollWait 出错之后 loop 退出，连接不能一直挂着
+	epfd := l.epfd
+	l.epfd = -1
+	require.NoError(t, syscall.Close(epfd))
+	go l.run()
+	_ = cConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = cConn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	assert.True(t, l.closed)
+	assert.Empty(t, l.conns)
+}
+
+// tcpPair 返回一对互相连接的 TCP 连接
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	cConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	sConn, err := listener.Accept()
+	require.NoError(t, err)
+	return cConn, sConn
+}
+
+func TestEventLoop_SlowPeer(t *testing.T) {
+	server := NewServer(ServerWithEventLoop(1))
+	server.RegisterService(&UserServiceServer{Msg: "go-rpc"})
+	addr := startServer(t, server)
+
+	// 对端只发送 ping，从来不读 pong。写 pong 不能阻塞 loop，排队太多的时候关闭连接
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		ping := encodeControl(false, message.KindPing, 0)
+		for {
+			if _, er := conn.Write(ping); er != nil {
+				errCh <- er
+				return
+			}
+		}
+	}()
+
+	usClient := &UserService{}
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.InitService(usClient))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	resp, err := usClient.GetById(ctx, &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "go-rpc", resp.Msg)
+
+	select {
+	case <-errCh:
+	case <-time.After(time.Second * 10):
+		t.Fatal("服务端没有关闭不读数据的连接")
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package go_rpc
+
+import (
+	"errors"
+	"net"
+)
+
+type eventLoops struct {
+}
+
+func newEventLoops(n int) (*eventLoops, error) {
+	return nil, errors.New("go-rpc: event loop is only supported on linux")
+}
+
+func (ls *eventLoops) wrap(conn net.Conn) *loopConn {
+	return nil
+}
+
+func (ls *eventLoops) close() {
+}
+
+type loopConn struct {
+	net.Conn
+}
+
+func (c *loopConn) start(s *Server, sc *serverConn) error {
+	return errors.New("go-rpc: event loop is only supported on linux")
+}
@@ -5,6 +5,7 @@ go 1.22
 require (
 	github.com/silenceper/pool v1.0.0
 	github.com/stretchr/testify v1.10.0
+	golang.org/x/sys v0.0.0-20190422165155-953cdadca894
 	google.golang.org/protobuf v1.35.2
 )
 
@@ -13,6 +14,5 @@ require (
 	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/sirupsen/logrus v1.4.2 // indirect
-	golang.org/x/sys v0.0.0-20190422165155-953cdadca894 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,447 @@
+package go_rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-rpc/internal/errs"
+	"go-rpc/message"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const grpcContentType = "application/grpc"
+
+// gRPC 的状态码，和 google.golang.org/grpc/codes 一致
+const (
+	GRPCOK                uint32 = 0
+	GRPCCanceled          uint32 = 1
+	GRPCUnknown           uint32 = 2
+	GRPCInvalidArgument   uint32 = 3
+	GRPCDeadlineExceeded  uint32 = 4
+	GRPCResourceExhausted uint32 = 8
+	GRPCUnimplemented     uint32 = 12
+	GRPCInternal          uint32 = 13
+	GRPCUnavailable       uint32 = 14
+)
+
+// grpcMessagePrefixBytes 是消息前面的压缩标记和长度
+const grpcMessagePrefixBytes = 5
+
+// grpcCodecs 是 content-type 里面的编码和序列化协议的对应关系，
+// application/grpc 没有后缀的时候是 proto
+var grpcCodecs = map[string]uint8{
+	"":      2,
+	"proto": 2,
+	"json":  1,
+}
+
+// GRPCError 是 gRPC 调用的状态。
+// 服务的方法返回 *GRPCError 的时候，gRPC 客户端会收到对应的状态码，
+// 其它的错误按照 GRPCUnknown 返回
+type GRPCError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *GRPCError) Error() string {
+	return fmt.Sprintf("go-rpc: grpc status %d: %s", e.Code, e.Message)
+}
+
+// grpcStatus 把调用的错误转换成 gRPC 的状态
+func grpcStatus(err error) *GRPCError {
+	var grpcErr *GRPCError
+	switch {
+	case errors.As(err, &grpcErr):
+		return grpcErr
+	case errors.Is(err, errs.ErrServiceNotFound), errors.Is(err, errs.ErrMethodNotFound):
+		return &GRPCError{Code: GRPCUnimplemented, Message: err.Error()}
+	case errors.Is(err, errs.ErrInvalidArgument):
+		return &GRPCError{Code: GRPCInvalidArgument, Message: err.Error()}
+	case errors.Is(err, errs.ErrServerDraining):
+		return &GRPCError{Code: GRPCUnavailable, Message: err.Error()}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &GRPCError{Code: GRPCDeadlineExceeded, Message: err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &GRPCError{Code: GRPCCanceled, Message: err.Error()}
+	default:
+		return &GRPCError{Code: GRPCUnknown, Message: err.Error()}
+	}
+}
+
+// isGRPCRequest 判断 HTTP 请求是不是 gRPC 调用，gRPC 只使用 HTTP/2
+func isGRPCRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.ProtoMajor == 2 &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), grpcContentType)
+}
+
+// serveGRPC 处理 gRPC 的 unary 调用。路径 /ServiceName/MethodName 决定调用哪个服务，
+// 所以给 gRPC 客户端调用的服务的 Name 应该返回带 package 的完整服务名，例如 helloworld.Greeter
+func (s *Server) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	s.httpActive.Add(1)
+	defer s.httpActive.Add(-1)
+	contentType := r.Header.Get("Content-Type")
+	codec, ok := grpcCodecs[strings.TrimPrefix(strings.TrimPrefix(contentType, grpcContentType), "+")]
+	if !ok {
+		http.Error(w, "unsupported content-type "+contentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	serviceName, methodName, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !ok {
+		writeGRPCStatus(w, &GRPCError{Code: GRPCUnimplemented, Message: "malformed method name " + r.URL.Path}, false)
+		return
+	}
+	if s.inShutdown.Load() {
+		writeGRPCStatus(w, grpcStatus(errs.ErrServerDraining), false)
+		return
+	}
+	data, err := readGRPCMessage(r.Body, s.maxBodySize)
+	if err != nil {
+		writeGRPCStatus(w, grpcStatus(err), false)
+		return
+	}
+
+	ctx := CtxWithPeer(r.Context(), peerFromHTTP(r))
+	if timeout := r.Header.Get("Grpc-Timeout"); timeout != "" {
+		d, er := parseGRPCTimeout(timeout)
+		if er != nil {
+			writeGRPCStatus(w, &GRPCError{Code: GRPCInternal, Message: er.Error()}, false)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	resp, err := s.Invoke(ctx, &message.Request{
+		Kind:        message.KindRequest,
+		Serializer:  codec,
+		ServiceName: serviceName,
+		MethodName:  methodName,
+		Data:        data,
+	})
+	if err == nil {
+		// handler 没有返回错误，但是已经过期的调用也要报告超时
+		err = ctx.Err()
+	}
+	if err != nil {
+		writeGRPCStatus(w, grpcStatus(err), false)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(encodeGRPCMessage(resp.Data))
+	writeGRPCStatus(w, &GRPCError{Code: GRPCOK}, true)
+}
+
+// writeGRPCStatus 写入调用的状态。还没有写响应的时候只发送 header，也就是 gRPC 的 Trailers-Only
+func writeGRPCStatus(w http.ResponseWriter, status *GRPCError, wroteBody bool) {
+	prefix := ""
+	if wroteBody {
+		prefix = http.TrailerPrefix
+	}
+	w.Header().Set(prefix+"Grpc-Status", strconv.FormatUint(uint64(status.Code), 10))
+	if status.Message != "" {
+		w.Header().Set(prefix+"Grpc-Message", encodeGRPCStatusMessage(status.Message))
+	}
+	if !wroteBody {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// readGRPCMessage 读取一个带长度前缀的消息，不支持压缩
+func readGRPCMessage(r io.Reader, maxSize uint32) ([]byte, error) {
+	var prefix [grpcMessagePrefixBytes]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, &GRPCError{Code: GRPCInternal, Message: "read message: " + err.Error()}
+	}
+	if prefix[0] != 0 {
+		return nil, &GRPCError{Code: GRPCUnimplemented, Message: "compressed message is not supported"}
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxSize {
+		return nil, &GRPCError{
+			Code:    GRPCResourceExhausted,
+			Message: fmt.Sprintf("message size %d exceeds limit %d", size, maxSize),
+		}
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, &GRPCError{Code: GRPCInternal, Message: "read message: " + err.Error()}
+	}
+	return data, nil
+}
+
+func encodeGRPCMessage(data []byte) []byte {
+	bs := make([]byte, grpcMessagePrefixBytes+len(data))
+	binary.BigEndian.PutUint32(bs[1:], uint32(len(data)))
+	copy(bs[grpcMessagePrefixBytes:], data)
+	return bs
+}
+
+// grpcTimeoutUnits 按照精度从高到低排列
+var grpcTimeoutUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'n', time.Nanosecond},
+	{'u', time.Microsecond},
+	{'m', time.Millisecond},
+	{'S', time.Second},
+	{'M', time.Minute},
+	{'H', time.Hour},
+}
+
+// parseGRPCTimeout 解析 grpc-timeout，格式是最多 8 位的数字加上单位
+func parseGRPCTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("go-rpc: malformed grpc-timeout %q", s)
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("go-rpc: malformed grpc-timeout %q", s)
+	}
+	for _, u := range grpcTimeoutUnits {
+		if u.unit == s[len(s)-1] {
+			return time.Duration(n) * u.d, nil
+		}
+	}
+	return 0, fmt.Errorf("go-rpc: malformed grpc-timeout %q", s)
+}
+
+// encodeGRPCTimeout 选择能用 8 位数字表示的精度最高的单位
+func encodeGRPCTimeout(d time.Duration) string {
+	const maxValue = 99999999
+	for _, u := range grpcTimeoutUnits {
+		// 向上取整，避免超时时间被缩短成 0
+		n := (d + u.d - 1) / u.d
+		if n <= maxValue {
+			return strconv.FormatInt(int64(n), 10) + string(u.unit)
+		}
+	}
+	return strconv.Itoa(maxValue) + "H"
+}
+
+// encodeGRPCStatusMessage 按照 gRPC 的要求对 grpc-message 做百分号编码，
+// 可打印的 ASCII 字符除了 % 都保持原样
+func encodeGRPCStatusMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= 0x20 && c <= 0x7e && c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&sb, "%%%02X", c)
+	}
+	return sb.String()
+}
+
+func decodeGRPCStatusMessage(msg string) string {
+	if res, err := url.PathUnescape(msg); err == nil {
+		return res
+	}
+	return msg
+}
+
+// GRPCTransport 让客户端调用 gRPC 服务端。addr 是服务端的 host:port，
+// 请求的 ServiceName 和 MethodName 组成 gRPC 的路径 /ServiceName/MethodName。
+// 客户端需要通过 ClientWithSerializer 使用 ProtoSerializer，
+// 或者在服务端支持 application/grpc+json 的时候使用 JSON。
+// gRPC 没有 oneway 调用，oneway 的请求会正常发出去，只是不等待结果
+type GRPCTransport struct {
+	// Client 为 nil 的时候使用按照下面的字段创建的 HTTP/2 客户端
+	Client *http.Client
+	// TLSConfig 为 nil 的时候使用不加密的 HTTP/2
+	TLSConfig *tls.Config
+
+	once   sync.Once
+	client *http.Client
+}
+
+func (t *GRPCTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	scheme := "http://"
+	if t.TLSConfig != nil {
+		scheme = "https://"
+	} else if t.Client == nil && !h2cSupported {
+		return nil, errH2CNotSupported
+	}
+	c := newHTTPConn(ctx, t.httpClient(), scheme+addr)
+	c.roundTrip = c.grpcRoundTrip
+	return c, nil
+}
+
+// Listen 使用 gRPC 的时候由支持 HTTP/2 的 http.Server 监听，把 Server 作为 Handler
+func (t *GRPCTransport) Listen(addr string) (net.Listener, error) {
+	return nil, errors.New("go-rpc: use Server as an http.Handler of an HTTP/2 server to serve grpc")
+}
+
+func (t *GRPCTransport) httpClient() *http.Client {
+	t.once.Do(func() {
+		if t.Client != nil {
+			t.client = t.Client
+			return
+		}
+		transport := &http.Transport{
+			TLSClientConfig:   t.TLSConfig,
+			ForceAttemptHTTP2: true,
+		}
+		if t.TLSConfig == nil {
+			enableH2C(transport)
+		}
+		t.client = &http.Client{Transport: transport}
+	})
+	return t.client
+}
+
+// grpcRoundTrip 把请求帧转换成 gRPC 调用，再把结果转换成响应帧。
+// gRPC 服务端不认识握手和心跳，它们在本地回复
+func (c *httpConn) grpcRoundTrip(ctx context.Context, frame []byte) ([]byte, error) {
+	req, err := message.DecodeReq(frame)
+	if err != nil {
+		return nil, err
+	}
+	switch req.Kind {
+	case 0, message.KindRequest:
+	case message.KindPing:
+		return encodeControl(true, message.KindPong, 0), nil
+	default:
+		return nil, nil
+	}
+	if req.ServiceName == message.HandshakeService && req.MethodName == message.HandshakeMethod {
+		return grpcHandshake(req), nil
+	}
+
+	resp := &message.Response{
+		Kind:       message.KindResponse,
+		RequestId:  req.RequestId,
+		Version:    req.Version,
+		Serializer: req.Serializer,
+	}
+	data, err := c.grpcInvoke(ctx, req)
+	var grpcErr *GRPCError
+	if errors.As(err, &grpcErr) {
+		resp.Error = []byte(grpcErr.Error())
+		if grpcErr.Code == GRPCUnavailable {
+			resp.Flags |= message.FlagRetryable
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if isOnewayReq(req) {
+		return nil, nil
+	}
+	resp.Data = data
+	return encodeResponse(resp), nil
+}
+
+func (c *httpConn) grpcInvoke(ctx context.Context, req *message.Request) ([]byte, error) {
+	var codec string
+	for name, code := range grpcCodecs {
+		if code == req.Serializer && name != "" {
+			codec = name
+		}
+	}
+	if codec == "" {
+		return nil, &GRPCError{
+			Code:    GRPCInternal,
+			Message: fmt.Sprintf("serializer %d is not supported by grpc", req.Serializer),
+		}
+	}
+	// 数据已经被压缩过的时候不能当作未压缩的 gRPC 消息发出去
+	if req.Compresser != 0 {
+		return nil, &GRPCError{
+			Code:    GRPCUnimplemented,
+			Message: fmt.Sprintf("compressor %d is not supported by grpc", req.Compresser),
+		}
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		c.url+"/"+req.ServiceName+"/"+req.MethodName, bytes.NewReader(encodeGRPCMessage(req.Data)))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", grpcContentType+"+"+codec)
+	httpReq.Header.Set("Te", "trailers")
+	if deadlineStr, ok := req.Meta["deadline"]; ok {
+		if deadline, er := strconv.ParseInt(deadlineStr, 10, 64); er == nil {
+			timeout := time.Until(time.UnixMilli(deadline))
+			if timeout <= 0 {
+				return nil, grpcStatus(context.DeadlineExceeded)
+			}
+			httpReq.Header.Set("Grpc-Timeout", encodeGRPCTimeout(timeout))
+		}
+	}
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w %s", errHTTPStatus, resp.Status)
+	}
+	var data []byte
+	// Trailers-Only 的响应在 header 里面带着状态，没有消息
+	status := resp.Header.Get("Grpc-Status")
+	if status == "" {
+		data, err = readGRPCMessage(resp.Body, c.maxBodySize)
+		var grpcErr *GRPCError
+		if err != nil && !errors.As(err, &grpcErr) {
+			return nil, err
+		}
+		// 读到 EOF 之后才能拿到 trailer
+		_, _ = io.Copy(io.Discard, resp.Body)
+		status = resp.Trailer.Get("Grpc-Status")
+		if status == "" {
+			if err != nil {
+				return nil, err
+			}
+			return nil, &GRPCError{Code: GRPCInternal, Message: "missing grpc-status"}
+		}
+	}
+	code, er := strconv.ParseUint(status, 10, 32)
+	if er != nil {
+		return nil, &GRPCError{Code: GRPCInternal, Message: "malformed grpc-status " + status}
+	}
+	if uint32(code) != GRPCOK {
+		msg := resp.Trailer.Get("Grpc-Message")
+		if msg == "" {
+			msg = resp.Header.Get("Grpc-Message")
+		}
+		return nil, &GRPCError{Code: uint32(code), Message: decodeGRPCStatusMessage(msg)}
+	}
+	return data, err
+}
+
+// grpcHandshake 在本地完成握手，使用当前最高的版本和 gRPC 支持的序列化协议。
+// gRPC 消息不支持压缩，所以不同意压缩
+func grpcHandshake(req *message.Request) []byte {
+	hs := &message.Handshake{
+		MinVersion: message.MaxSupportedVersion,
+		MaxVersion: message.MaxSupportedVersion,
+		Features:   supportedFeatures &^ message.FeatureCompression,
+	}
+	if proposal, err := message.DecodeHandshake(req.Data); err == nil {
+		for _, code := range proposal.Serializers {
+			if code == grpcCodecs["proto"] || code == grpcCodecs["json"] {
+				hs.Serializers = append(hs.Serializers, code)
+			}
+		}
+	}
+	return encodeResponse(&message.Response{
+		Kind:       message.KindResponse,
+		RequestId:  req.RequestId,
+		Version:    req.Version,
+		Serializer: req.Serializer,
+		Data:       hs.Encode(),
+	})
+}
@@ -0,0 +1,299 @@
+package go_rpc
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-rpc/compress"
+	"go-rpc/message"
+	"go-rpc/serialize"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGRPCTransport(t *testing.T) {
+	addr := startGRPCServer(t, &GreeterServer{})
+	greeter := &Greeter{}
+	client, err := NewClient(addr, ClientWithTransport(&GRPCTransport{}),
+		ClientWithSerializer(&serialize.ProtoSerializer{}))
+	require.NoError(t, err)
+	require.NoError(t, client.InitService(greeter))
+
+	testCases := []struct {
+		name    string
+		timeout time.Duration
+		req     int64
+		wantMsg string
+		wantErr string
+	}{
+		{
+			name:    "ok",
+			req:     0,
+			wantMsg: "hello",
+		},
+		{
+			name:    "status",
+			req:     -1,
+			wantErr: "go-rpc: grpc status 5: 用户不存在",
+		},
+		{
+			name:    "timeout",
+			timeout: time.Millisecond * 100,
+			req:     1000,
+			// 服务端按照 grpc-timeout 超时和客户端自己超时都有可能先发生
+			wantErr: "deadline exceeded",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+			resp, er := greeter.SayHello(ctx, wrapperspb.Int64(tc.req))
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, er, tc.wantErr)
+				return
+			}
+			require.NoError(t, er)
+			assert.Equal(t, tc.wantMsg, resp.GetValue())
+		})
+	}
+}
+
+func TestGRPCTransport_Compressor(t *testing.T) {
+	addr := startGRPCServer(t, &GreeterServer{})
+	greeter := &Greeter{}
+	// gRPC 的握手不同意压缩，客户端设置了压缩也发送原始数据
+	client, err := NewClient(addr, ClientWithTransport(&GRPCTransport{}),
+		ClientWithSerializer(&serialize.ProtoSerializer{}), ClientWithCompressor(&compress.GzipCompressor{}))
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.InitService(greeter))
+
+	// 服务端解出了原始的请求才会返回这个状态
+	_, err = greeter.SayHello(context.Background(), wrapperspb.Int64(-1))
+	assert.ErrorContains(t, err, "go-rpc: grpc status 5: 用户不存在")
+
+	// 直接调用 Invoke 发送压缩过的数据会被拒绝
+	data, err := (&compress.GzipCompressor{}).Compress(mustMarshal(t, wrapperspb.Int64(-1)))
+	require.NoError(t, err)
+	resp, err := client.Invoke(context.Background(), &message.Request{
+		ServiceName: greeter.Name(),
+		MethodName:  "SayHello",
+		Data:        data,
+		Serializer:  (&serialize.ProtoSerializer{}).Code(),
+		Compresser:  (&compress.GzipCompressor{}).Code(),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "go-rpc: grpc status 12: compressor 1 is not supported by grpc", string(resp.Error))
+}
+
+func TestServer_ServeGRPC(t *testing.T) {
+	addr := startGRPCServer(t, &GreeterServer{})
+	client := newH2CClient(t)
+
+	testCases := []struct {
+		name        string
+		path        string
+		header      http.Header
+		body        []byte
+		wantStatus  string
+		wantMessage string
+		wantResp    string
+	}{
+		{
+			name:       "ok",
+			path:       "/test.Greeter/SayHello",
+			body:       encodeGRPCMessage(mustMarshal(t, wrapperspb.Int64(0))),
+			wantStatus: "0",
+			wantResp:   "hello",
+		},
+		{
+			name:        "handler status",
+			path:        "/test.Greeter/SayHello",
+			body:        encodeGRPCMessage(mustMarshal(t, wrapperspb.Int64(-1))),
+			wantStatus:  "5",
+			wantMessage: "%E7%94%A8%E6%88%B7%E4%B8%8D%E5%AD%98%E5%9C%A8",
+		},
+		{
+			name:        "unknown service",
+			path:        "/test.Unknown/SayHello",
+			body:        encodeGRPCMessage(nil),
+			wantStatus:  "12",
+			wantMessage: "go-rpc: service not found",
+		},
+		{
+			name:        "unknown method",
+			path:        "/test.Greeter/Unknown",
+			body:        encodeGRPCMessage(nil),
+			wantStatus:  "12",
+			wantMessage: "go-rpc: method not found: Unknown",
+		},
+		{
+			name:        "first param is not context",
+			path:        "/test.Greeter/NoContext",
+			body:        encodeGRPCMessage(nil),
+			wantStatus:  "12",
+			wantMessage: "go-rpc: method not found: NoContext",
+		},
+		{
+			name:        "second result is not error",
+			path:        "/test.Greeter/NoError",
+			body:        encodeGRPCMessage(nil),
+			wantStatus:  "12",
+			wantMessage: "go-rpc: method not found: NoError",
+		},
+		{
+			name:        "compressed",
+			path:        "/test.Greeter/SayHello",
+			body:        []byte{1, 0, 0, 0, 0},
+			wantStatus:  "12",
+			wantMessage: "compressed message is not supported",
+		},
+		{
+			name:       "timeout",
+			path:       "/test.Greeter/SayHello",
+			header:     http.Header{"Grpc-Timeout": {"50m"}},
+			body:       encodeGRPCMessage(mustMarshal(t, wrapperspb.Int64(1000))),
+			wantStatus: "4",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "http://"+addr+tc.path, bytes.NewReader(tc.body))
+			require.NoError(t, err)
+			req.Header = tc.header
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			req.Header.Set("Content-Type", "application/grpc")
+			req.Header.Set("Te", "trailers")
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "application/grpc", resp.Header.Get("Content-Type"))
+
+			if tc.wantResp == "" {
+				// Trailers-Only
+				assert.Equal(t, tc.wantStatus, resp.Header.Get("Grpc-Status"))
+				if tc.wantMessage != "" {
+					assert.Equal(t, tc.wantMessage, resp.Header.Get("Grpc-Message"))
+				}
+				return
+			}
+			data, err := readGRPCMessage(resp.Body, DefaultMaxBodySize)
+			require.NoError(t, err)
+			msg := &wrapperspb.StringValue{}
+			require.NoError(t, proto.Unmarshal(data, msg))
+			assert.Equal(t, tc.wantResp, msg.GetValue())
+			_, err = resp.Body.Read(make([]byte, 1))
+			require.Error(t, err)
+			assert.Equal(t, tc.wantStatus, resp.Trailer.Get("Grpc-Status"))
+		})
+	}
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	testCases := []struct {
+		timeout string
+		d       time.Duration
+		encode  bool
+		wantErr bool
+	}{
+		{timeout: "100m", d: time.Millisecond * 100},
+		{timeout: "1500000u", d: time.Millisecond * 1500, encode: true},
+		{timeout: "2S", d: time.Second * 2},
+		{timeout: "3H", d: time.Hour * 3},
+		{timeout: "1n", d: time.Nanosecond, encode: true},
+		{timeout: "100000000S", wantErr: true},
+		{timeout: "10", wantErr: true},
+		{timeout: "m", wantErr: true},
+		{timeout: "-1m", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.timeout, func(t *testing.T) {
+			d, err := parseGRPCTimeout(tc.timeout)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.d, d)
+			if tc.encode {
+				assert.Equal(t, tc.timeout, encodeGRPCTimeout(tc.d))
+			}
+		})
+	}
+}
+
+// startGRPCServer 用支持 h2c 的 http.Server 提供 gRPC 服务
+func startGRPCServer(t *testing.T, service Service) string {
+	server := NewServer()
+	server.RegisterService(service)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	httpServer := &http.Server{Handler: server}
+	serveH2C(t, httpServer)
+	go func() {
+		_ = httpServer.Serve(l)
+	}()
+	t.Cleanup(func() {
+		_ = httpServer.Close()
+	})
+	return l.Addr().String()
+}
+
+func mustMarshal(t *testing.T, msg proto.Message) []byte {
+	data, err := proto.Marshal(msg)
+	require.NoError(t, err)
+	return data
+}
+
+type Greeter struct {
+	SayHello func(ctx context.Context, req *wrapperspb.Int64Value) (*wrapperspb.StringValue, error)
+}
+
+func (g *Greeter) Name() string {
+	return "test.Greeter"
+}
+
+// GreeterServer 按照请求的值返回结果：0 成功，-1 返回 NotFound，大于 0 的时候阻塞这么多毫秒
+type GreeterServer struct{}
+
+func (g *GreeterServer) SayHello(ctx context.Context, req *wrapperspb.Int64Value) (*wrapperspb.StringValue, error) {
+	switch {
+	case req.GetValue() < 0:
+		return nil, &GRPCError{Code: 5, Message: "用户不存在"}
+	case req.GetValue() > 0:
+		select {
+		case <-time.After(time.Duration(req.GetValue()) * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return wrapperspb.String("hello"), nil
+}
+
+func (g *GreeterServer) Name() string {
+	return "test.Greeter"
+}
+
+// NoContext 和 NoError 的签名不是 RPC 方法，客户端调用的时候应该找不到方法
+func (g *GreeterServer) NoContext(name string, req *wrapperspb.Int64Value) (*wrapperspb.StringValue, error) {
+	return wrapperspb.String(name), nil
+}
+
+func (g *GreeterServer) NoError(ctx context.Context, req *wrapperspb.Int64Value) (*wrapperspb.StringValue, string) {
+	return wrapperspb.String("hello"), "not an error"
+}
@@ -0,0 +1,15 @@
+//go:build go1.24
+
+package go_rpc
+
+import "net/http"
+
+// h2cSupported 表示标准库支持明文的 HTTP/2（h2c），Go 1.24 开始才有
+const h2cSupported = true
+
+// enableH2C 让 transport 在 http:// 上使用 HTTP/2
+func enableH2C(transport *http.Transport) {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	transport.Protocols = protocols
+}
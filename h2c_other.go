@@ -0,0 +1,10 @@
+//go:build !go1.24
+
+package go_rpc
+
+import "net/http"
+
+const h2cSupported = false
+
+func enableH2C(transport *http.Transport) {
+}
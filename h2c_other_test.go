@@ -0,0 +1,17 @@
+//go:build !go1.24
+
+package go_rpc
+
+import (
+	"net/http"
+	"testing"
+)
+
+func serveH2C(t *testing.T, server *http.Server) {
+	t.Skip("h2c 需要 Go 1.24")
+}
+
+func newH2CClient(t *testing.T) *http.Client {
+	t.Skip("h2c 需要 Go 1.24")
+	return nil
+}
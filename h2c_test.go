@@ -0,0 +1,22 @@
+//go:build go1.24
+
+package go_rpc
+
+import (
+	"net/http"
+	"testing"
+)
+
+// serveH2C 让 server 同时支持 HTTP/1.1 和 h2c
+func serveH2C(t *testing.T, server *http.Server) {
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+}
+
+// newH2CClient 返回只使用 h2c 的客户端
+func newH2CClient(t *testing.T) *http.Client {
+	transport := &http.Transport{}
+	enableH2C(transport)
+	return &http.Client{Transport: transport}
+}
@@ -0,0 +1,165 @@
+package go_rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-rpc/internal/errs"
+	"go-rpc/message"
+	"io"
+	"net"
+	"sort"
+	"syscall"
+)
+
+// errHandshakeClosed 表示服务端没有回复握手请求就关闭了连接
+var errHandshakeClosed = errors.New("go-rpc: server closed the connection during handshake")
+
+// supportedFeatures 是当前实现支持的特性
+const supportedFeatures = message.FeatureCompression | message.FeatureMultiplexing
+
+// negotiate 从客户端的提议里面选出双方都支持的最高版本、共同的特性和序列化协议
+func (s *Server) negotiate(hs *message.Handshake) (*message.Handshake, error) {
+	version := min(hs.MaxVersion, message.MaxSupportedVersion)
+	if version < max(hs.MinVersion, message.MinSupportedVersion) {
+		return nil, &message.UnsupportedVersionError{
+			MinVersion:   hs.MinVersion,
+			MaxVersion:   hs.MaxVersion,
+			SupportedMin: message.MinSupportedVersion,
+			SupportedMax: message.MaxSupportedVersion,
+		}
+	}
+	res := &message.Handshake{
+		MinVersion: version,
+		MaxVersion: version,
+		Features:   hs.Features & supportedFeatures,
+	}
+	for _, code := range hs.Serializers {
+		if _, ok := s.serializes[code]; ok {
+			res.Serializers = append(res.Serializers, code)
+		}
+	}
+	return res, nil
+}
+
+// handshake 回复客户端的握手请求，之后的心跳按照协商出来的版本发送
+func (s *Server) handshake(sc *serverConn, req *message.Request) error {
+	resp, hs := s.handshakeResponse(req)
+	if hs != nil {
+		sc.mutex.Lock()
+		sc.version = hs.MaxVersion
+		sc.mutex.Unlock()
+	}
+	return sc.write(encodeResponse(resp))
+}
+
+// handshakeResponse 根据客户端的提议生成握手的响应，协商失败的时候 hs 为 nil，
+// 并且在 body 里面带上服务端支持的版本范围和序列化协议
+func (s *Server) handshakeResponse(req *message.Request) (resp *message.Response, hs *message.Handshake) {
+	resp = &message.Response{
+		Kind:       message.KindResponse,
+		RequestId:  req.RequestId,
+		Version:    req.Version,
+		Serializer: req.Serializer,
+	}
+	hs, err := message.DecodeHandshake(req.Data)
+	if err == nil {
+		hs, err = s.negotiate(hs)
+	}
+	if err != nil {
+		resp.Error = []byte(err.Error())
+		resp.Data = s.supported().Encode()
+		return resp, nil
+	}
+	resp.Data = hs.Encode()
+	return resp, hs
+}
+
+func (s *Server) supported() *message.Handshake {
+	hs := &message.Handshake{
+		MinVersion: message.MinSupportedVersion,
+		MaxVersion: message.MaxSupportedVersion,
+		Features:   supportedFeatures,
+	}
+	for code := range s.serializes {
+		hs.Serializers = append(hs.Serializers, code)
+	}
+	sort.Slice(hs.Serializers, func(i, j int) bool {
+		return hs.Serializers[i] < hs.Serializers[j]
+	})
+	return hs
+}
+
+// handshake 和服务端协商版本、特性和序列化协议，结果保存在连接上
+func (cc *clientConn) handshake(ctx context.Context, id uint32, serializers []uint8) error {
+	proposal := &message.Handshake{
+		MinVersion:  message.MinSupportedVersion,
+		MaxVersion:  message.MaxSupportedVersion,
+		Features:    supportedFeatures,
+		Serializers: serializers,
+	}
+	req := &message.Request{
+		Kind:        message.KindRequest,
+		RequestId:   id,
+		Version:     message.Version1,
+		ServiceName: message.HandshakeService,
+		MethodName:  message.HandshakeMethod,
+		Data:        proposal.Encode(),
+	}
+	req.CalculateHeaderLength()
+	req.CalculateBodyLength()
+	resp, err := cc.send(ctx, req)
+	if err != nil {
+		// 最早的服务端处理不了握手请求，不回复任何数据就关闭或者重置连接，
+		// 这个连接已经不能用了，由调用者重新建立连接
+		if isConnClosedByPeer(err) {
+			return fmt.Errorf("%w: %w", errHandshakeClosed, err)
+		}
+		return err
+	}
+
+	hs, decodeErr := message.DecodeHandshake(resp.Data)
+	if len(resp.Error) > 0 {
+		if decodeErr != nil {
+			// 不认识握手的老服务端把它当成普通请求，回复了服务不存在，只能使用 Version1
+			cc.version = message.Version1
+			cc.serializers = serializers
+			return nil
+		}
+		if hs.MaxVersion < proposal.MinVersion || hs.MinVersion > proposal.MaxVersion {
+			return &message.UnsupportedVersionError{
+				MinVersion:   proposal.MinVersion,
+				MaxVersion:   proposal.MaxVersion,
+				SupportedMin: hs.MinVersion,
+				SupportedMax: hs.MaxVersion,
+			}
+		}
+		return errors.New(string(resp.Error))
+	}
+	if decodeErr != nil {
+		return decodeErr
+	}
+	if len(hs.Serializers) == 0 {
+		return fmt.Errorf("%w: %v", errs.ErrSerializerNotSupported, serializers)
+	}
+	cc.version = hs.MaxVersion
+	cc.features = hs.Features
+	cc.serializers = hs.Serializers
+	return nil
+}
+
+// isConnClosedByPeer 判断 err 是不是对端关闭或者重置了连接
+func isConnClosedByPeer(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// checkSerializer 检查服务端是否支持这个序列化协议
+func (cc *clientConn) checkSerializer(code uint8) error {
+	for _, c := range cc.serializers {
+		if c == code {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %d", errs.ErrSerializerNotSupported, code)
+}
@@ -0,0 +1,200 @@
+package go_rpc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-rpc/message"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_negotiate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		hs      *message.Handshake
+		wantRes *message.Handshake
+		wantErr error
+	}{
+		{
+			name: "highest common version",
+			hs: &message.Handshake{
+				MinVersion:  message.Version1,
+				MaxVersion:  100,
+				Features:    message.FeatureCompression | message.FeatureMultiplexing | message.FeatureStreaming,
+				Serializers: []uint8{2, 1, 99},
+			},
+			wantRes: &message.Handshake{
+				MinVersion:  message.MaxSupportedVersion,
+				MaxVersion:  message.MaxSupportedVersion,
+				Features:    message.FeatureCompression | message.FeatureMultiplexing,
+				Serializers: []uint8{2, 1},
+			},
+		},
+		{
+			name: "old client",
+			hs: &message.Handshake{
+				MinVersion:  message.Version1,
+				MaxVersion:  message.Version1,
+				Serializers: []uint8{1},
+			},
+			wantRes: &message.Handshake{
+				MinVersion:  message.Version1,
+				MaxVersion:  message.Version1,
+				Serializers: []uint8{1},
+			},
+		},
+		{
+			name: "unsupported version",
+			hs: &message.Handshake{
+				MinVersion:  100,
+				MaxVersion:  101,
+				Serializers: []uint8{1},
+			},
+			wantErr: &message.UnsupportedVersionError{
+				MinVersion:   100,
+				MaxVersion:   101,
+				SupportedMin: message.MinSupportedVersion,
+				SupportedMax: message.MaxSupportedVersion,
+			},
+		},
+	}
+
+	s := NewServer()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := s.negotiate(tc.hs)
+			assert.Equal(t, tc.wantErr, err)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tc.wantRes, res)
+		})
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+	cConn, sConn := net.Pipe()
+	go func() {
+		_ = server.handleConn(sConn)
+	}()
+	cc := newClientConn(cConn, NewFrameReader(cConn, DefaultMaxHeaderSize, DefaultMaxBodySize))
+	defer cc.close(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := cc.handshake(ctx, 1, []uint8{1})
+	require.NoError(t, err)
+	assert.Equal(t, message.MaxSupportedVersion, cc.version)
+	assert.Equal(t, message.FeatureCompression|message.FeatureMultiplexing, cc.features)
+	assert.Equal(t, []uint8{1}, cc.serializers)
+
+	err = cc.handshake(ctx, 2, []uint8{99})
+	assert.ErrorContains(t, err, "serializer not supported")
+}
+
+func TestHandshake_BaselineServer(t *testing.T) {
+	testCases := []struct {
+		name  string
+		reset bool
+	}{
+		{
+			name: "close",
+		},
+		{
+			name:  "reset",
+			reset: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer()
+			server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer l.Close()
+			go serveBaseline(l, server, tc.reset)
+
+			// 握手的连接被关闭之后，客户端重新建立连接并且使用 Version1
+			client, err := NewClient(l.Addr().String())
+			require.NoError(t, err)
+			defer client.Close()
+			usClient := &UserService{}
+			require.NoError(t, client.InitService(usClient))
+			resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+			require.NoError(t, err)
+			assert.Equal(t, "hello, world", resp.Msg)
+		})
+	}
+}
+
+// serveBaseline 模拟最早的服务端：不认识握手，调用不存在的服务的时候不回复，直接关闭连接。
+// reset 为 true 的时候用 RST 关闭连接
+func serveBaseline(l net.Listener, server *Server, reset bool) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			fr := NewFrameReader(conn, DefaultMaxHeaderSize, DefaultMaxBodySize)
+			for {
+				bs, err := fr.ReadFrame()
+				if err != nil {
+					return
+				}
+				req, err := message.DecodeReq(bs)
+				if err != nil {
+					return
+				}
+				resp, err := server.Invoke(context.Background(), req)
+				if err != nil {
+					if reset {
+						_ = conn.(*net.TCPConn).SetLinger(0)
+					}
+					return
+				}
+				if _, err = conn.Write(encodeResponse(resp)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestUnsupportedVersionRequest(t *testing.T) {
+	server := NewServer()
+	cConn, sConn := net.Pipe()
+	go func() {
+		_ = server.handleConn(sConn)
+	}()
+	cc := newClientConn(cConn, NewFrameReader(cConn, DefaultMaxHeaderSize, DefaultMaxBodySize))
+	defer cc.close(nil)
+
+	req := &message.Request{
+		RequestId:   1,
+		Version:     message.MaxSupportedVersion + 1,
+		ServiceName: "user-service",
+		MethodName:  "GetById",
+	}
+	req.CalculateHeaderLength()
+	req.CalculateBodyLength()
+	resp, err := cc.send(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, message.Version1, resp.Version)
+	assert.Equal(t, (&message.UnsupportedVersionError{
+		MinVersion:   req.Version,
+		MaxVersion:   req.Version,
+		SupportedMin: message.MinSupportedVersion,
+		SupportedMax: message.MaxSupportedVersion,
+	}).Error(), string(resp.Error))
+	hs, err := message.DecodeHandshake(resp.Data)
+	require.NoError(t, err)
+	assert.Equal(t, message.MinSupportedVersion, hs.MinVersion)
+	assert.Equal(t, message.MaxSupportedVersion, hs.MaxVersion)
+}
@@ -0,0 +1,108 @@
+package go_rpc
+
+import (
+	"go-rpc/internal/errs"
+	"go-rpc/message"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultHeartbeatInterval = time.Second * 30
+	DefaultHeartbeatTimeout  = time.Second * 90
+)
+
+// keepalive 检测对端是否还活着。
+// 连接空闲超过 interval 就发送一个 ping，超过 timeout 没有读到任何帧就关闭连接。
+// 它用定时器实现，不需要为每个连接额外启动一个 goroutine
+type keepalive struct {
+	interval time.Duration
+	timeout  time.Duration
+
+	ping  func() error
+	close func(err error)
+
+	// lastRead 是最后一次读到帧的时间
+	lastRead atomic.Int64
+	// pinging 保证同一时间只有一个 ping 在发送，
+	// 对端不读数据的时候写操作会阻塞，不能因此卡住超时检测
+	pinging atomic.Bool
+
+	mutex   sync.Mutex
+	stopped bool
+	timer   *time.Timer
+}
+
+func newKeepalive(interval, timeout time.Duration, ping func() error, close func(err error)) *keepalive {
+	k := &keepalive{
+		interval: interval,
+		timeout:  timeout,
+		ping:     ping,
+		close:    close,
+	}
+	k.touch()
+	k.mutex.Lock()
+	k.timer = time.AfterFunc(interval, k.tick)
+	k.mutex.Unlock()
+	return k
+}
+
+// touch 在每次读到帧的时候调用
+func (k *keepalive) touch() {
+	k.lastRead.Store(time.Now().UnixNano())
+}
+
+func (k *keepalive) tick() {
+	k.mutex.Lock()
+	stopped := k.stopped
+	k.mutex.Unlock()
+	if stopped {
+		return
+	}
+	idle := time.Since(time.Unix(0, k.lastRead.Load()))
+	if idle >= k.timeout {
+		k.close(errs.ErrHeartbeatTimeout)
+		return
+	}
+	if idle >= k.interval && k.pinging.CompareAndSwap(false, true) {
+		go func() {
+			defer k.pinging.Store(false)
+			if err := k.ping(); err != nil {
+				k.close(err)
+			}
+		}()
+	}
+	// 下一次在空闲满 interval 的时候检查，刚发过 ping 的时候再等一个 interval
+	next := k.interval - idle
+	if next <= 0 {
+		next = k.interval
+	}
+	k.mutex.Lock()
+	if !k.stopped {
+		k.timer.Reset(min(next, k.timeout-idle))
+	}
+	k.mutex.Unlock()
+}
+
+func (k *keepalive) stop() {
+	k.mutex.Lock()
+	k.stopped = true
+	k.timer.Stop()
+	k.mutex.Unlock()
+}
+
+// encodeControl 生成 Version3 的控制帧，比如心跳。
+// 服务端发送的帧按照响应编码，客户端发送的帧按照请求编码
+func encodeControl(fromServer bool, kind uint8, id uint32) []byte {
+	if fromServer {
+		resp := &message.Response{Kind: kind, RequestId: id, Version: message.Version3}
+		resp.CalculateHeaderLength()
+		resp.CalculateBodyLength()
+		return resp.Encode()
+	}
+	req := &message.Request{Kind: kind, RequestId: id, Version: message.Version3}
+	req.CalculateHeaderLength()
+	req.CalculateBodyLength()
+	return req.Encode()
+}
@@ -0,0 +1,137 @@
+package go_rpc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-rpc/internal/errs"
+	"go-rpc/message"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat_Alive(t *testing.T) {
+	server := NewServer(ServerWithHeartbeat(time.Millisecond*50, time.Millisecond*200))
+	server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+	cConn, sConn := net.Pipe()
+	go func() {
+		_ = server.handleConn(sConn)
+	}()
+	cc := newClientConn(cConn, NewFrameReader(cConn, DefaultMaxHeaderSize, DefaultMaxBodySize))
+	defer cc.close(nil)
+	require.NoError(t, cc.handshake(context.Background(), 1, []uint8{1}))
+	cc.startKeepalive(time.Millisecond*50, time.Millisecond*200)
+
+	// 双方都空闲，只靠心跳维持连接
+	time.Sleep(time.Millisecond * 600)
+	assert.False(t, cc.isClosed())
+
+	resp, err := cc.send(context.Background(), newGetByIdReq(2, cc.version))
+	require.NoError(t, err)
+	assert.Equal(t, `{"Msg":"hello, world"}`, string(resp.Data))
+}
+
+func TestKeepalive_PingAfterInterval(t *testing.T) {
+	pinged := make(chan time.Time, 1)
+	k := newKeepalive(time.Millisecond*100, time.Second, func() error {
+		select {
+		case pinged <- time.Now():
+		default:
+		}
+		return nil
+	}, func(err error) {})
+	defer k.stop()
+	// 第一次检查之前有读到数据，空闲满 interval 的时候就要发送 ping，而不是再等一个 interval
+	time.Sleep(time.Millisecond * 40)
+	k.touch()
+	lastRead := time.Now()
+	select {
+	case at := <-pinged:
+		assert.Less(t, at.Sub(lastRead), time.Millisecond*150)
+	case <-time.After(time.Second):
+		t.Fatal("no ping")
+	}
+}
+
+func TestHeartbeat_ServerNotResponding(t *testing.T) {
+	cConn, sConn := net.Pipe()
+	// 服务端只读不写
+	go func() {
+		_, _ = io.Copy(io.Discard, sConn)
+	}()
+	cc := newClientConn(cConn, NewFrameReader(cConn, DefaultMaxHeaderSize, DefaultMaxBodySize))
+	cc.version = message.Version3
+	cc.startKeepalive(time.Millisecond*50, time.Millisecond*200)
+
+	select {
+	case <-cc.closed:
+		assert.Equal(t, errs.ErrHeartbeatTimeout, cc.err)
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestHeartbeat_ClientNotResponding(t *testing.T) {
+	server := NewServer(ServerWithHeartbeat(time.Millisecond*50, time.Millisecond*200))
+	cConn, sConn := net.Pipe()
+	defer cConn.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.handleConn(sConn)
+	}()
+
+	// 握手之后客户端就不再读写了
+	hs := &message.Handshake{
+		MinVersion:  message.Version3,
+		MaxVersion:  message.Version3,
+		Serializers: []uint8{1},
+	}
+	req := &message.Request{
+		Version:     message.Version1,
+		ServiceName: message.HandshakeService,
+		MethodName:  message.HandshakeMethod,
+		Data:        hs.Encode(),
+	}
+	req.CalculateHeaderLength()
+	req.CalculateBodyLength()
+	require.NoError(t, NewFrameWriter(cConn).WriteFrame(req.Encode()))
+	_, err := NewFrameReader(cConn, DefaultMaxHeaderSize, DefaultMaxBodySize).ReadFrame()
+	require.NoError(t, err)
+
+	select {
+	case err = <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestHeartbeat_OldClient(t *testing.T) {
+	server := NewServer(ServerWithHeartbeat(time.Millisecond*50, time.Millisecond*200))
+	server.RegisterService(&UserServiceServerSlow{})
+	cConn, sConn := net.Pipe()
+	defer cConn.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.handleConn(sConn)
+	}()
+	cc := newClientConn(cConn, NewFrameReader(cConn, DefaultMaxHeaderSize, DefaultMaxBodySize))
+
+	// 老客户端不认识 ping，等待响应的时候连接不算空闲
+	req := newGetByIdReq(1, message.Version1)
+	req.Data = []byte(`{"Id":50}`)
+	req.CalculateBodyLength()
+	resp, err := cc.send(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, `{"Msg":"50"}`, string(resp.Data))
+
+	// 之后一直空闲，超过 timeout 就关闭连接
+	select {
+	case err = <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+}
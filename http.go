@@ -0,0 +1,417 @@
+package go_rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go-rpc/internal/errs"
+	"go-rpc/message"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HTTPContentType 是 HTTP 请求和响应的 Content-Type
+const HTTPContentType = "application/x-go-rpc"
+
+var (
+	errHTTPStatus      = errors.New("go-rpc: unexpected http status")
+	errH2CNotSupported = errors.New("go-rpc: h2c requires go1.24")
+)
+
+// ServeHTTP 让 Server 可以挂在 HTTP 服务器上。
+// 请求的 body 是一个编码好的请求帧，响应的 body 是对应的响应帧，
+// oneway 请求和不需要回复的控制帧返回 204。调用哪个服务还是由帧里面的 ServiceName 和 MethodName 决定。
+// 客户端断开 HTTP 请求的时候，正在执行的方法会被取消。
+// 挂在支持 HTTP/2 的服务器上的时候，gRPC 客户端也可以直接调用注册的服务；
+// Content-Type 是 application/json 的请求按照 JSON-RPC 2.0 处理
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isGRPCRequest(r) {
+		s.serveGRPC(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if isJSONRPCRequest(r) {
+		s.serveJSONRPC(w, r)
+		return
+	}
+	s.httpActive.Add(1)
+	defer s.httpActive.Add(-1)
+	reqBs, err := NewFrameReader(r.Body, s.maxHeaderSize, s.maxBodySize).ReadFrame()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := CtxWithPeer(r.Context(), peerFromHTTP(r))
+	data := s.serveHTTPFrame(ctx, reqBs)
+	if data == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", HTTPContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	_, _ = w.Write(data)
+}
+
+// serveHTTPFrame 处理 HTTP 请求里面的帧，返回需要回复的帧。
+// HTTP 请求之间没有连接的状态，握手只用来协商版本
+func (s *Server) serveHTTPFrame(ctx context.Context, reqBs []byte) []byte {
+	req, err := message.DecodeReq(reqBs)
+	if err != nil {
+		return encodeResponse(protocolErrorResponse(reqBs, err))
+	}
+	switch req.Kind {
+	case 0, message.KindRequest:
+	case message.KindPing:
+		return encodeControl(true, message.KindPong, 0)
+	default:
+		// 取消通过断开 HTTP 请求实现，其它控制帧不需要回复
+		return nil
+	}
+	if req.ServiceName == message.HandshakeService && req.MethodName == message.HandshakeMethod {
+		resp, _ := s.handshakeResponse(req)
+		return encodeResponse(resp)
+	}
+	oneway := isOnewayReq(req)
+	if s.inShutdown.Load() {
+		if oneway {
+			return nil
+		}
+		return encodeResponse(rejectResponse(req, errs.ErrServerDraining))
+	}
+
+	if oneway {
+		// 请求结束之后 HTTP 的 context 就会被取消，oneway 请求不能使用它
+		s.httpActive.Add(1)
+		go func() {
+			defer s.httpActive.Add(-1)
+			ctx, cancel := withDeadline(context.WithoutCancel(ctx), req)
+			defer cancel()
+			_, _ = s.Invoke(CtxWithOneway(ctx), req)
+		}()
+		return nil
+	}
+	ctx, cancel := withDeadline(ctx, req)
+	defer cancel()
+	resp, err := s.Invoke(ctx, req)
+	if err != nil {
+		setResponseError(resp, err)
+	}
+	return encodeResponse(resp)
+}
+
+func peerFromHTTP(r *http.Request) *Peer {
+	p := &Peer{Addr: httpAddr(r.RemoteAddr)}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		p.Addr = addr
+	}
+	if r.TLS != nil {
+		p.setTLS(r.TLS)
+	}
+	return p
+}
+
+// HTTPTransport 通过 HTTP POST 调用挂在 HTTP 服务器上的 Server。
+// 每个请求帧是一个 POST 请求，多个调用可以同时进行，
+// 服务端支持的时候 https 会自动使用 HTTP/2，多个调用共用同一个 TCP 连接。
+// 地址是 http:// 或者 https:// 开头的 URL，没有路径的时候使用 Path
+type HTTPTransport struct {
+	// Client 为 nil 的时候使用按照下面的字段创建的客户端
+	Client *http.Client
+	Path   string
+	// TLSConfig 是 https 使用的配置
+	TLSConfig *tls.Config
+	// UnencryptedHTTP2 为 true 的时候 http:// 也使用 HTTP/2，服务端必须支持 h2c。
+	// 标准库从 Go 1.24 开始支持 h2c，之前的版本 Dial 会返回错误
+	UnencryptedHTTP2 bool
+
+	once   sync.Once
+	client *http.Client
+}
+
+func (t *HTTPTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("go-rpc: unsupported http scheme %q", u.Scheme)
+	}
+	if u.Path == "" {
+		u.Path = t.Path
+	}
+	if t.UnencryptedHTTP2 && t.Client == nil && !h2cSupported {
+		return nil, errH2CNotSupported
+	}
+	return newHTTPConn(ctx, t.httpClient(), u.String()), nil
+}
+
+// Listen 使用 HTTP 的时候由 http.Server 监听，把 Server 作为 Handler
+func (t *HTTPTransport) Listen(addr string) (net.Listener, error) {
+	return nil, errors.New("go-rpc: use Server as an http.Handler to serve over http")
+}
+
+// httpClient 在第一次使用的时候创建客户端，同一个 Transport 的连接共用连接池
+func (t *HTTPTransport) httpClient() *http.Client {
+	t.once.Do(func() {
+		if t.Client != nil {
+			t.client = t.Client
+			return
+		}
+		transport := &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   t.TLSConfig,
+			ForceAttemptHTTP2: true,
+		}
+		if t.UnencryptedHTTP2 {
+			enableH2C(transport)
+		}
+		t.client = &http.Client{Transport: transport}
+	})
+	return t.client
+}
+
+// httpConn 把 HTTP 请求包装成 net.Conn。
+// 写进来的每个帧用一个 POST 发出去，响应里面的帧按照收到的顺序读出来。
+// cancel 帧不会发给服务端，而是断开对应的 HTTP 请求
+type httpConn struct {
+	client *http.Client
+	url    string
+	// maxHeaderSize 和 maxBodySize 限制响应的大小，来自 Dial 的 ctx
+	maxHeaderSize uint32
+	maxBodySize   uint32
+	// roundTrip 发出一个帧并且返回响应帧，没有响应的时候返回 nil
+	roundTrip func(ctx context.Context, frame []byte) ([]byte, error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wbuf 是还不够一个帧的数据
+	writeMutex sync.Mutex
+	wbuf       []byte
+
+	mutex    sync.Mutex
+	inflight map[uint32]context.CancelFunc
+	deadline time.Time
+	// err 是让连接不能再使用的错误
+	err error
+
+	frames chan []byte
+	rbuf   []byte
+}
+
+// newHTTPConn 创建连接，响应的大小上限从 dialCtx 里面读取
+func newHTTPConn(dialCtx context.Context, client *http.Client, url string) *httpConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &httpConn{
+		client:   client,
+		url:      url,
+		ctx:      ctx,
+		cancel:   cancel,
+		inflight: make(map[uint32]context.CancelFunc, 16),
+		frames:   make(chan []byte, 16),
+	}
+	c.maxHeaderSize, c.maxBodySize = frameLimitsFromContext(dialCtx)
+	c.roundTrip = c.post
+	return c
+}
+
+func (c *httpConn) Write(p []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, net.ErrClosed
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.wbuf = append(c.wbuf, p...)
+	for {
+		frame, err := splitFrame(c.wbuf, math.MaxUint32, math.MaxUint32)
+		if err != nil {
+			return 0, err
+		}
+		if frame == nil {
+			break
+		}
+		c.wbuf = c.wbuf[len(frame):]
+		c.send(bytes.Clone(frame))
+	}
+	if len(c.wbuf) == 0 {
+		c.wbuf = nil
+	}
+	return len(p), nil
+}
+
+func (c *httpConn) send(frame []byte) {
+	id, version := message.PeekHeader(frame)
+	if message.IsTyped(frame) && frame[2] == message.KindCancel {
+		c.mutex.Lock()
+		cancel, ok := c.inflight[id]
+		c.mutex.Unlock()
+		if ok {
+			cancel()
+		}
+		return
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	// 控制帧的 ID 是 0，不需要取消
+	if id != 0 {
+		c.mutex.Lock()
+		c.inflight[id] = cancel
+		c.mutex.Unlock()
+	}
+	go func() {
+		defer func() {
+			if id != 0 {
+				c.mutex.Lock()
+				delete(c.inflight, id)
+				c.mutex.Unlock()
+			}
+			cancel()
+		}()
+		data, err := c.roundTrip(ctx, frame)
+		if err != nil {
+			if ctx.Err() != nil {
+				// 调用者已经不要这个响应了
+				return
+			}
+			if !errors.Is(err, errHTTPStatus) && !errors.Is(err, errs.ErrFrameTooLarge) {
+				// 连不上服务端，和 TCP 连接断开一样处理
+				c.fail(err)
+				return
+			}
+			// 让等待这个请求的调用者拿到错误，不影响其它请求
+			data = encodeResponse(&message.Response{
+				Kind:      message.KindResponse,
+				RequestId: id,
+				Version:   version,
+				Error:     []byte(err.Error()),
+			})
+		}
+		if len(data) == 0 {
+			return
+		}
+		select {
+		case c.frames <- data:
+		case <-c.ctx.Done():
+		}
+	}()
+}
+
+func (c *httpConn) post(ctx context.Context, frame []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", HTTPContentType)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// 和服务端一样限制读取的数据量，不让出错的服务端耗尽内存
+		limit := int64(c.maxHeaderSize) + int64(c.maxBodySize)
+		data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > limit {
+			return nil, fmt.Errorf("%w: http response exceeds %d bytes", errs.ErrFrameTooLarge, limit)
+		}
+		return data, nil
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%w %s", errHTTPStatus, resp.Status)
+	}
+}
+
+func (c *httpConn) Read(p []byte) (int, error) {
+	if len(c.rbuf) == 0 {
+		c.mutex.Lock()
+		deadline := c.deadline
+		c.mutex.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case c.rbuf = <-c.frames:
+		case <-c.ctx.Done():
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			if c.err != nil {
+				return 0, c.err
+			}
+			return 0, io.EOF
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *httpConn) fail(err error) {
+	c.mutex.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mutex.Unlock()
+	c.cancel()
+}
+
+// Close 断开所有正在进行的 HTTP 请求
+func (c *httpConn) Close() error {
+	c.cancel()
+	return nil
+}
+
+func (c *httpConn) LocalAddr() net.Addr {
+	return httpAddr("")
+}
+
+func (c *httpConn) RemoteAddr() net.Addr {
+	return httpAddr(c.url)
+}
+
+func (c *httpConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *httpConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.deadline = t
+	c.mutex.Unlock()
+	return nil
+}
+
+// SetWriteDeadline 没有效果，写只是发起 HTTP 请求，不会阻塞
+func (c *httpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type httpAddr string
+
+func (a httpAddr) Network() string {
+	return "http"
+}
+
+func (a httpAddr) String() string {
+	return string(a)
+}
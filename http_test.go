@@ -0,0 +1,271 @@
+package go_rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-rpc/message"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "server", time.Hour, func(tmpl *x509.Certificate) {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	})
+
+	testCases := []struct {
+		name       string
+		start      func(t *testing.T, ts *httptest.Server)
+		clientOpts []ClientOption
+		scheme     string
+		wantProto  int32
+	}{
+		{
+			name: "http/1.1",
+			start: func(t *testing.T, ts *httptest.Server) {
+				ts.Start()
+			},
+			scheme:    "http://",
+			wantProto: 1,
+		},
+		{
+			name: "h2c",
+			start: func(t *testing.T, ts *httptest.Server) {
+				serveH2C(t, ts.Config)
+				ts.Start()
+			},
+			clientOpts: []ClientOption{ClientWithTransport(&HTTPTransport{UnencryptedHTTP2: true})},
+			scheme:     "http://",
+			wantProto:  2,
+		},
+		{
+			name: "https/2",
+			start: func(t *testing.T, ts *httptest.Server) {
+				ts.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+				ts.EnableHTTP2 = true
+				ts.StartTLS()
+			},
+			clientOpts: []ClientOption{ClientWithTransport(&HTTPTransport{
+				TLSConfig: &tls.Config{RootCAs: ca.pool},
+			})},
+			scheme:    "https://",
+			wantProto: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer()
+			server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+			var proto atomic.Int32
+			mux := http.NewServeMux()
+			mux.Handle("/rpc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				proto.Store(int32(r.ProtoMajor))
+				server.ServeHTTP(w, r)
+			}))
+			ts := httptest.NewUnstartedServer(mux)
+			tc.start(t, ts)
+			defer ts.Close()
+
+			usClient := &UserService{}
+			client, err := NewClient(tc.scheme+ts.Listener.Addr().String()+"/rpc", tc.clientOpts...)
+			require.NoError(t, err)
+			require.NoError(t, client.InitService(usClient))
+			resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 123})
+			require.NoError(t, err)
+			assert.Equal(t, &GetByIdResp{Msg: "hello, world"}, resp)
+			assert.Equal(t, tc.wantProto, proto.Load())
+
+			// oneway 请求没有响应
+			resp, err = usClient.GetById(CtxWithOneway(context.Background()), &GetByIdReq{Id: 123})
+			assert.Equal(t, &GetByIdResp{}, resp)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestServer_ServeHTTP(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	req := newGetByIdReq(1, message.Version2)
+	oneway := newGetByIdReq(2, message.Version2)
+	oneway.Meta = map[string]string{"one-way": "true"}
+	oneway.CalculateHeaderLength()
+	// Version3 只看标记位，元数据里面的 one-way 不起作用
+	metaOneway := newGetByIdReq(1, message.Version3)
+	metaOneway.Meta = map[string]string{"one-way": "true"}
+	metaOneway.CalculateHeaderLength()
+
+	testCases := []struct {
+		name       string
+		method     string
+		body       []byte
+		wantStatus int
+		wantResp   string
+	}{
+		{
+			name:       "get",
+			method:     http.MethodGet,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "malformed",
+			method:     http.MethodPost,
+			body:       []byte{0, 0, 0},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "request",
+			method:     http.MethodPost,
+			body:       req.Encode(),
+			wantStatus: http.StatusOK,
+			wantResp:   `{"Msg":"hello, world"}`,
+		},
+		{
+			name:       "oneway",
+			method:     http.MethodPost,
+			body:       oneway.Encode(),
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "v3 oneway meta",
+			method:     http.MethodPost,
+			body:       metaOneway.Encode(),
+			wantStatus: http.StatusOK,
+			wantResp:   `{"Msg":"hello, world"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			httpReq, err := http.NewRequest(tc.method, ts.URL, bytes.NewReader(tc.body))
+			require.NoError(t, err)
+			httpResp, err := http.DefaultClient.Do(httpReq)
+			require.NoError(t, err)
+			defer httpResp.Body.Close()
+			assert.Equal(t, tc.wantStatus, httpResp.StatusCode)
+			if tc.wantResp == "" {
+				return
+			}
+			assert.Equal(t, HTTPContentType, httpResp.Header.Get("Content-Type"))
+			data, err := NewFrameReader(httpResp.Body, DefaultMaxHeaderSize, DefaultMaxBodySize).ReadFrame()
+			require.NoError(t, err)
+			resp, err := message.DecodeRes(data)
+			require.NoError(t, err)
+			assert.Equal(t, req.RequestId, resp.RequestId)
+			assert.Equal(t, tc.wantResp, string(resp.Data))
+		})
+	}
+}
+
+func TestHTTPTransport_ResponseLimit(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+	// 握手交给 Server 处理，调用返回一个超过上限的 body
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		req, err := message.DecodeReq(body)
+		require.NoError(t, err)
+		if req.ServiceName == message.HandshakeService {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			server.ServeHTTP(w, r)
+			return
+		}
+		_, _ = w.Write(make([]byte, 1<<20))
+	}))
+	defer ts.Close()
+
+	client, err := NewClient(ts.URL, ClientWithFrameLimits(DefaultMaxHeaderSize, 1024))
+	require.NoError(t, err)
+	defer client.Close()
+	usClient := &UserService{}
+	require.NoError(t, client.InitService(usClient))
+	// 只有这次调用失败，连接还可以继续使用
+	for i := 0; i < 2; i++ {
+		_, err = usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+		assert.ErrorContains(t, err, "frame too large")
+	}
+}
+
+func TestHTTPTransport_Cancel(t *testing.T) {
+	server := NewServer()
+	service := &UserServiceServerBlocking{done: make(chan error, 1)}
+	server.RegisterService(service)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	usClient := &UserService{}
+	client, err := NewClient(ts.URL)
+	require.NoError(t, err)
+	require.NoError(t, client.InitService(usClient))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+	}()
+	_, err = usClient.GetById(ctx, &GetByIdReq{Id: 123})
+	assert.Equal(t, context.Canceled, err)
+
+	select {
+	case err = <-service.done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("handler not canceled")
+	}
+}
+
+func TestHTTPTransport_Unreachable(t *testing.T) {
+	ts := httptest.NewServer(NewServer())
+	addr := ts.URL
+	ts.Close()
+
+	_, err := NewClient(addr)
+	assert.Error(t, err)
+}
+
+func TestServer_ShutdownHTTP(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServerSlow{})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	usClient := &UserService{}
+	client, err := NewClient(ts.URL)
+	require.NoError(t, err)
+	require.NoError(t, client.InitService(usClient))
+
+	done := make(chan error, 1)
+	go func() {
+		_, er := usClient.GetById(context.Background(), &GetByIdReq{Id: 100})
+		done <- er
+	}()
+	require.Eventually(t, func() bool {
+		return server.httpActive.Load() > 0
+	}, time.Second, time.Millisecond*10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	require.NoError(t, server.Shutdown(ctx))
+	assert.Equal(t, int32(0), server.httpActive.Load())
+	assert.NoError(t, <-done)
+
+	// Shutdown 之后的请求被拒绝
+	_, err = usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+	assert.Error(t, err)
+}
@@ -3,5 +3,31 @@ package errs
 import "errors"
 
 var (
-	ErrIsOneway = errors.New("go-rpc: warn! this is oneway")
+	ErrIsOneway     = errors.New("go-rpc: warn! this is oneway")
+	ErrConnClosed   = errors.New("go-rpc: connection closed")
+	ErrClientClosed = errors.New("go-rpc: client closed")
+	// ErrClientConnecting 表示客户端正在建立连接，调用需要等待它的结果
+	ErrClientConnecting = errors.New("go-rpc: client is connecting")
+
+	ErrHeartbeatTimeout = errors.New("go-rpc: heartbeat timeout, peer is not responding")
+	ErrCanceledByClient = errors.New("go-rpc: request canceled by client")
+
+	ErrServerClosed   = errors.New("go-rpc: server closed")
+	ErrServerDraining = errors.New("go-rpc: server is draining")
+	ErrWriteQueueFull = errors.New("go-rpc: write queue full, peer is not reading")
+
+	ErrFrameTooLarge  = errors.New("go-rpc: frame too large")
+	ErrTruncatedFrame = errors.New("go-rpc: truncated frame")
+
+	ErrMalformedMessage = errors.New("go-rpc: malformed message")
+
+	ErrSerializerNotSupported = errors.New("go-rpc: serializer not supported by server")
+	ErrCompressorNotSupported = errors.New("go-rpc: compressor not supported")
+
+	// ErrRetryable 标记可以重试的错误
+	ErrRetryable = errors.New("go-rpc: retryable")
+
+	ErrServiceNotFound = errors.New("go-rpc: service not found")
+	ErrMethodNotFound  = errors.New("go-rpc: method not found")
+	ErrInvalidArgument = errors.New("go-rpc: invalid argument")
 )
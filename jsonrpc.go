@@ -0,0 +1,331 @@
+package go_rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-rpc/internal/errs"
+	"go-rpc/message"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JSON-RPC 2.0 的错误码
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCInternalError  = -32603
+	// JSONRPCServerError 是服务的方法返回的错误，-32000 到 -32099 是留给实现自己定义的
+	JSONRPCServerError = -32000
+)
+
+// jsonrpcSerializer 是 JsonSerializer 的编号，params 原样交给它解析
+const jsonrpcSerializer uint8 = 1
+
+// JSONRPCError 是 JSON-RPC 响应里面的 error。
+// 服务的方法返回 *JSONRPCError 的时候原样返回给调用者，其它的错误按照 JSONRPCServerError 返回
+type JSONRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e *JSONRPCError) Error() string {
+	return fmt.Sprintf("go-rpc: json-rpc error %d: %s", e.Code, e.Message)
+}
+
+// jsonrpcError 把调用的错误转换成 JSON-RPC 的 error
+func jsonrpcError(err error) *JSONRPCError {
+	var rpcErr *JSONRPCError
+	switch {
+	case errors.As(err, &rpcErr):
+		return rpcErr
+	case errors.Is(err, errs.ErrServiceNotFound), errors.Is(err, errs.ErrMethodNotFound):
+		return &JSONRPCError{Code: JSONRPCMethodNotFound, Message: err.Error()}
+	case errors.Is(err, errs.ErrInvalidArgument):
+		return &JSONRPCError{Code: JSONRPCInvalidParams, Message: err.Error()}
+	default:
+		return &JSONRPCError{Code: JSONRPCServerError, Message: err.Error()}
+	}
+}
+
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	// ID 没有出现的时候是 nil，这个请求是通知；出现但是值为 null 的时候是 "null"
+	ID json.RawMessage `json:"id"`
+}
+
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+func newJSONRPCErrorResponse(id json.RawMessage, err *JSONRPCError) *jsonrpcResponse {
+	return &jsonrpcResponse{JSONRPC: "2.0", Error: err, ID: id}
+}
+
+// handleJSONRPC 处理一个请求或者批量请求，返回编码好的响应，没有需要回复的内容的时候返回 nil。
+// 通知按照 oneway 请求处理，detach 负责在后台执行它们
+func (s *Server) handleJSONRPC(ctx context.Context, data []byte, detach func(fn func())) []byte {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '[' {
+		resp := s.invokeJSONRPC(ctx, data, detach)
+		if resp == nil {
+			return nil
+		}
+		res, _ := json.Marshal(resp)
+		return res
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(data, &batch); err != nil {
+		res, _ := json.Marshal(newJSONRPCErrorResponse(nil, &JSONRPCError{
+			Code:    JSONRPCParseError,
+			Message: err.Error(),
+		}))
+		return res
+	}
+	if len(batch) == 0 {
+		res, _ := json.Marshal(newJSONRPCErrorResponse(nil, &JSONRPCError{
+			Code:    JSONRPCInvalidRequest,
+			Message: "empty batch",
+		}))
+		return res
+	}
+	// 批量请求里面的调用并发执行，响应按照请求的顺序排列
+	resps := make([]*jsonrpcResponse, len(batch))
+	var wg sync.WaitGroup
+	for i, raw := range batch {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resps[i] = s.invokeJSONRPC(ctx, raw, detach)
+		}()
+	}
+	wg.Wait()
+	res := make([]*jsonrpcResponse, 0, len(resps))
+	for _, resp := range resps {
+		if resp != nil {
+			res = append(res, resp)
+		}
+	}
+	// 全部都是通知的时候什么都不回复
+	if len(res) == 0 {
+		return nil
+	}
+	bs, _ := json.Marshal(res)
+	return bs
+}
+
+// invokeJSONRPC 执行一个调用。method 的格式是 ServiceName.MethodName，
+// 服务名里面可以有点，最后一个点后面的是方法名。
+// params 是对象的时候直接作为方法的参数，是数组的时候只能有一个元素
+func (s *Server) invokeJSONRPC(ctx context.Context, data []byte, detach func(fn func())) *jsonrpcResponse {
+	var req jsonrpcRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) || errors.Is(err, io.ErrUnexpectedEOF) || len(data) == 0 {
+			return newJSONRPCErrorResponse(nil, &JSONRPCError{Code: JSONRPCParseError, Message: err.Error()})
+		}
+		return newJSONRPCErrorResponse(nil, &JSONRPCError{Code: JSONRPCInvalidRequest, Message: err.Error()})
+	}
+	if !validJSONRPCID(req.ID) {
+		return newJSONRPCErrorResponse(nil, &JSONRPCError{
+			Code:    JSONRPCInvalidRequest,
+			Message: "id must be a string, number or null",
+		})
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return newJSONRPCErrorResponse(req.ID, &JSONRPCError{
+			Code:    JSONRPCInvalidRequest,
+			Message: `jsonrpc must be "2.0" and method must not be empty`,
+		})
+	}
+	notification := req.ID == nil
+
+	idx := strings.LastIndexByte(req.Method, '.')
+	if idx <= 0 || idx == len(req.Method)-1 {
+		if notification {
+			return nil
+		}
+		return newJSONRPCErrorResponse(req.ID, &JSONRPCError{
+			Code:    JSONRPCMethodNotFound,
+			Message: fmt.Sprintf("%s: %s", errs.ErrMethodNotFound.Error(), req.Method),
+		})
+	}
+	params, err := jsonrpcParams(req.Params)
+	if err != nil {
+		if notification {
+			return nil
+		}
+		return newJSONRPCErrorResponse(req.ID, &JSONRPCError{Code: JSONRPCInvalidParams, Message: err.Error()})
+	}
+	rpcReq := &message.Request{
+		Kind:        message.KindRequest,
+		Serializer:  jsonrpcSerializer,
+		ServiceName: req.Method[:idx],
+		MethodName:  req.Method[idx+1:],
+		Data:        params,
+	}
+
+	if notification {
+		if s.inShutdown.Load() {
+			return nil
+		}
+		// 调用者不等待结果，所以请求结束之后也不取消它
+		ctx = CtxWithOneway(context.WithoutCancel(ctx))
+		detach(func() {
+			_, _ = s.Invoke(ctx, rpcReq)
+		})
+		return nil
+	}
+	if s.inShutdown.Load() {
+		return newJSONRPCErrorResponse(req.ID, jsonrpcError(errs.ErrServerDraining))
+	}
+	resp, err := s.Invoke(ctx, rpcReq)
+	if err != nil {
+		return newJSONRPCErrorResponse(req.ID, jsonrpcError(err))
+	}
+	result := json.RawMessage(resp.Data)
+	if len(result) == 0 {
+		result = json.RawMessage("null")
+	}
+	return &jsonrpcResponse{JSONRPC: "2.0", Result: result, ID: req.ID}
+}
+
+func validJSONRPCID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+	switch id[0] {
+	case '"', 'n':
+		return true
+	default:
+		_, err := strconv.ParseFloat(string(id), 64)
+		return err == nil
+	}
+}
+
+// jsonrpcParams 把 params 转换成方法参数的 JSON，没有 params 的时候参数是零值
+func jsonrpcParams(params json.RawMessage) ([]byte, error) {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || string(params) == "null" {
+		return []byte("{}"), nil
+	}
+	switch params[0] {
+	case '{':
+		return params, nil
+	case '[':
+		var arr []json.RawMessage
+		if err := json.Unmarshal(params, &arr); err != nil {
+			return nil, err
+		}
+		if len(arr) != 1 {
+			return nil, fmt.Errorf("%w: params must contain exactly one element, got %d",
+				errs.ErrInvalidArgument, len(arr))
+		}
+		return arr[0], nil
+	default:
+		return nil, fmt.Errorf("%w: params must be an object or an array", errs.ErrInvalidArgument)
+	}
+}
+
+// ServeJSONRPC 在 listener 上接收 JSON-RPC 2.0 的连接。每一行是一个请求或者批量请求，
+// 每个响应也占一行。同一个连接上的请求并发执行，响应的顺序和请求的顺序不一定相同，调用者用 id 对应它们。
+// 和 Serve 一样，Close 和 Shutdown 会关闭 listener 和连接
+func (s *Server) ServeJSONRPC(listener net.Listener) error {
+	return s.accept(listener, nil, s.handleJSONRPCConn)
+}
+
+func (s *Server) handleJSONRPCConn(conn net.Conn) error {
+	peer, err := newPeer(conn)
+	if err != nil {
+		return err
+	}
+	sc := newServerConn(conn, peer)
+	if !s.trackConn(sc) {
+		return errs.ErrServerClosed
+	}
+	defer s.releaseConn(sc)
+	detach := func(fn func()) {
+		sc.active.Add(1)
+		go func() {
+			defer sc.active.Add(-1)
+			fn()
+		}()
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), int(s.maxBodySize))
+	for scanner.Scan() {
+		line := bytes.Clone(scanner.Bytes())
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		sc.active.Add(1)
+		go func() {
+			defer sc.active.Add(-1)
+			data := s.handleJSONRPC(sc.ctx, line, detach)
+			if data == nil {
+				return
+			}
+			if er := sc.fw.WriteFrame(append(data, '\n')); er != nil {
+				_ = sc.conn.Close()
+			}
+		}()
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// isJSONRPCRequest 判断 HTTP 请求是不是 JSON-RPC 调用
+func isJSONRPCRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// serveJSONRPC 处理 HTTP 上的 JSON-RPC 调用，全部都是通知的时候返回 204
+func (s *Server) serveJSONRPC(w http.ResponseWriter, r *http.Request) {
+	s.httpActive.Add(1)
+	defer s.httpActive.Add(-1)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.maxBodySize)))
+	if err != nil {
+		status := http.StatusBadRequest
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	ctx := CtxWithPeer(r.Context(), peerFromHTTP(r))
+	data := s.handleJSONRPC(ctx, body, func(fn func()) {
+		s.httpActive.Add(1)
+		go func() {
+			defer s.httpActive.Add(-1)
+			fn()
+		}()
+	})
+	if data == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,210 @@
+package go_rpc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer_ServeJSONRPC(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServerSlow{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = server.ServeJSONRPC(l)
+	}()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	testCases := []struct {
+		name     string
+		req      string
+		wantResp string
+	}{
+		{
+			name:     "call",
+			req:      `{"jsonrpc":"2.0","method":"user-service.GetById","params":{"Id":1},"id":1}`,
+			wantResp: `{"jsonrpc":"2.0","result":{"Msg":"1"},"id":1}`,
+		},
+		{
+			name:     "by position",
+			req:      `{"jsonrpc":"2.0","method":"user-service.GetById","params":[{"Id":2}],"id":"a"}`,
+			wantResp: `{"jsonrpc":"2.0","result":{"Msg":"2"},"id":"a"}`,
+		},
+		{
+			name:     "no params",
+			req:      `{"jsonrpc":"2.0","method":"user-service.GetById","id":null}`,
+			wantResp: `{"jsonrpc":"2.0","result":{"Msg":"0"},"id":null}`,
+		},
+		{
+			name:     "parse error",
+			req:      `{"jsonrpc":"2.0","method"`,
+			wantResp: `{"jsonrpc":"2.0","error":{"code":-32700,"message":"unexpected end of JSON input"},"id":null}`,
+		},
+		{
+			name:     "invalid request",
+			req:      `{"jsonrpc":"1.0","method":"user-service.GetById","id":3}`,
+			wantResp: `{"jsonrpc":"2.0","error":{"code":-32600,"message":"jsonrpc must be \"2.0\" and method must not be empty"},"id":3}`,
+		},
+		{
+			name:     "invalid id",
+			req:      `{"jsonrpc":"2.0","method":"user-service.GetById","id":{}}`,
+			wantResp: `{"jsonrpc":"2.0","error":{"code":-32600,"message":"id must be a string, number or null"},"id":null}`,
+		},
+		{
+			name:     "unknown service",
+			req:      `{"jsonrpc":"2.0","method":"order-service.GetById","id":4}`,
+			wantResp: `{"jsonrpc":"2.0","error":{"code":-32601,"message":"go-rpc: service not found"},"id":4}`,
+		},
+		{
+			name:     "unknown method",
+			req:      `{"jsonrpc":"2.0","method":"user-service.Name","id":5}`,
+			wantResp: `{"jsonrpc":"2.0","error":{"code":-32601,"message":"go-rpc: method not found: Name"},"id":5}`,
+		},
+		{
+			name:     "no service",
+			req:      `{"jsonrpc":"2.0","method":"GetById","id":6}`,
+			wantResp: `{"jsonrpc":"2.0","error":{"code":-32601,"message":"go-rpc: method not found: GetById"},"id":6}`,
+		},
+		{
+			name:     "invalid params",
+			req:      `{"jsonrpc":"2.0","method":"user-service.GetById","params":{"Id":"abc"},"id":7}`,
+			wantResp: `{"jsonrpc":"2.0","error":{"code":-32602,"message":"go-rpc: invalid argument: json: cannot unmarshal string into Go struct field GetByIdReq.Id of type int"},"id":7}`,
+		},
+		{
+			name:     "too many params",
+			req:      `{"jsonrpc":"2.0","method":"user-service.GetById","params":[{},{}],"id":8}`,
+			wantResp: `{"jsonrpc":"2.0","error":{"code":-32602,"message":"go-rpc: invalid argument: params must contain exactly one element, got 2"},"id":8}`,
+		},
+		{
+			name:     "empty batch",
+			req:      `[]`,
+			wantResp: `{"jsonrpc":"2.0","error":{"code":-32600,"message":"empty batch"},"id":null}`,
+		},
+		{
+			// 通知没有响应，批量请求里面的响应按照请求的顺序排列
+			name: "batch",
+			req: `[{"jsonrpc":"2.0","method":"user-service.GetById","params":{"Id":5},"id":1},` +
+				`{"jsonrpc":"2.0","method":"user-service.GetById","params":{"Id":1}},` +
+				`1,` +
+				`{"jsonrpc":"2.0","method":"user-service.GetById","params":{"Id":1},"id":2}]`,
+			wantResp: `[{"jsonrpc":"2.0","result":{"Msg":"5"},"id":1},` +
+				`{"jsonrpc":"2.0","error":{"code":-32600,"message":"json: cannot unmarshal number into Go value of type go_rpc.jsonrpcRequest"},"id":null},` +
+				`{"jsonrpc":"2.0","result":{"Msg":"1"},"id":2}]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err = conn.Write([]byte(tc.req + "\n"))
+			require.NoError(t, err)
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.wantResp, line)
+		})
+	}
+}
+
+func TestServer_ServeJSONRPC_Notification(t *testing.T) {
+	server := NewServer()
+	service := &UserServiceServerCounter{}
+	server.RegisterService(service)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = server.ServeJSONRPC(l)
+	}()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte(`{"jsonrpc":"2.0","method":"user-service.GetById","params":{"Id":1}}` + "\n" +
+		`[{"jsonrpc":"2.0","method":"user-service.GetById"},{"jsonrpc":"2.0","method":"user-service.GetById"}]` + "\n"))
+	require.NoError(t, err)
+	// 关闭连接之后通知还是会执行完
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		return service.calls.Load() == 3
+	}, time.Second, time.Millisecond*10)
+	assert.True(t, service.oneway.Load())
+}
+
+func TestServer_ServeHTTP_JSONRPC(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{Err: errors.New("用户不存在")})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	testCases := []struct {
+		name       string
+		req        string
+		wantStatus int
+		wantResp   string
+	}{
+		{
+			name:       "handler error",
+			req:        `{"jsonrpc":"2.0","method":"user-service.GetById","params":{"Id":1},"id":1}`,
+			wantStatus: http.StatusOK,
+			wantResp:   `{"jsonrpc":"2.0","error":{"code":-32000,"message":"用户不存在"},"id":1}`,
+		},
+		{
+			name:       "notification",
+			req:        `{"jsonrpc":"2.0","method":"user-service.GetById","params":{"Id":1}}`,
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "batch",
+			req:        `[{"jsonrpc":"2.0","method":"user-service.GetById","id":1},{"jsonrpc":"2.0","method":"a.b","id":2}]`,
+			wantStatus: http.StatusOK,
+			wantResp: `[{"jsonrpc":"2.0","error":{"code":-32000,"message":"用户不存在"},"id":1},` +
+				`{"jsonrpc":"2.0","error":{"code":-32601,"message":"go-rpc: service not found"},"id":2}]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := http.Post(ts.URL, "application/json", strings.NewReader(tc.req))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.wantStatus, resp.StatusCode)
+			if tc.wantResp == "" {
+				return
+			}
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			var sb strings.Builder
+			_, err = bufio.NewReader(resp.Body).WriteTo(&sb)
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.wantResp, sb.String())
+		})
+	}
+}
+
+// UserServiceServerCounter 记录被调用的次数，以及是不是按照 oneway 调用的
+type UserServiceServerCounter struct {
+	calls  atomic.Int32
+	oneway atomic.Bool
+}
+
+func (u *UserServiceServerCounter) GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	u.oneway.Store(isOneway(ctx))
+	u.calls.Add(1)
+	return &GetByIdResp{}, nil
+}
+
+func (u *UserServiceServerCounter) Name() string {
+	return "user-service"
+}
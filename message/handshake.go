@@ -0,0 +1,75 @@
+package message
+
+import (
+	"fmt"
+	"go-rpc/internal/errs"
+)
+
+// 握手的时候协商的特性
+const (
+	FeatureCompression uint8 = 1 << iota
+	FeatureMultiplexing
+	FeatureStreaming
+)
+
+const (
+	// HandshakeService 和 HandshakeMethod 标记握手请求。
+	// 握手请求总是用 Version1 编码，这样任何版本的服务端都能解析。
+	// 不认识握手的老服务端会回复服务不存在，最早的服务端则不回复直接关闭连接，
+	// 这两种情况客户端都退回到 Version1
+	HandshakeService = "go-rpc"
+	HandshakeMethod  = "Handshake"
+)
+
+// Handshake 是握手请求和响应的 body。
+// 客户端填写自己支持的版本范围、特性和序列化协议；
+// 服务端回复协商的结果，这时候 MinVersion 和 MaxVersion 都是选中的版本。
+// 如果协商失败，服务端在响应里面带上错误，并且在 body 里面回复自己支持的版本范围
+type Handshake struct {
+	MinVersion  uint8
+	MaxVersion  uint8
+	Features    uint8
+	Serializers []uint8
+}
+
+func (h *Handshake) Encode() []byte {
+	bs := make([]byte, 4+len(h.Serializers))
+	bs[0] = h.MinVersion
+	bs[1] = h.MaxVersion
+	bs[2] = h.Features
+	bs[3] = uint8(len(h.Serializers))
+	copy(bs[4:], h.Serializers)
+	return bs
+}
+
+func DecodeHandshake(data []byte) (*Handshake, error) {
+	if len(data) < 4 || len(data) != 4+int(data[3]) {
+		return nil, fmt.Errorf("%w: handshake is %d bytes", errs.ErrMalformedMessage, len(data))
+	}
+	h := &Handshake{
+		MinVersion: data[0],
+		MaxVersion: data[1],
+		Features:   data[2],
+	}
+	if data[3] > 0 {
+		h.Serializers = append([]uint8(nil), data[4:]...)
+	}
+	if h.MinVersion > h.MaxVersion {
+		return nil, fmt.Errorf("%w: handshake version range %d-%d", errs.ErrMalformedMessage, h.MinVersion, h.MaxVersion)
+	}
+	return h, nil
+}
+
+// UnsupportedVersionError 表示对端使用的版本不在支持的范围里面
+type UnsupportedVersionError struct {
+	MinVersion uint8
+	MaxVersion uint8
+	// SupportedMin 和 SupportedMax 是服务端支持的版本范围
+	SupportedMin uint8
+	SupportedMax uint8
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("go-rpc: unsupported protocol version %d-%d, supported %d-%d",
+		e.MinVersion, e.MaxVersion, e.SupportedMin, e.SupportedMax)
+}
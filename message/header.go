@@ -0,0 +1,185 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+	"go-rpc/internal/errs"
+	"sort"
+)
+
+const (
+	// Version1 的头部用 '\n' 分隔服务名、方法名和元数据，元数据的 key 和 value 用 '\r' 分隔。
+	// 0 也按照 Version1 处理，兼容没有设置版本号的老客户端
+	Version1 uint8 = 1
+	// Version2 的头部里面每个字段前面都带上 4 个字节的长度，所以字段可以包含任意字节
+	Version2 uint8 = 2
+	// Version3 在 Version2 的基础上，在帧的最前面加上魔数、帧类型和标记位
+	Version3 uint8 = 3
+
+	// MinSupportedVersion 和 MaxSupportedVersion 是当前实现能够编解码的版本范围
+	MinSupportedVersion = Version1
+	MaxSupportedVersion = Version3
+)
+
+// MagicNumber 是 Version3 帧的前两个字节。
+// 老的帧以头部长度开头，头部不超过 16MB 的时候第一个字节总是 0，所以两种帧可以直接区分
+const MagicNumber uint16 = 0xC0DE
+
+// 帧类型。Version3 之前的帧没有类型，Kind 是 0，按照请求或者响应处理
+const (
+	KindRequest uint8 = iota + 1
+	KindResponse
+	KindPing
+	KindPong
+	KindCancel
+	KindGoAway
+	KindStreamData
+)
+
+// 标记位
+const (
+	FlagOneway uint8 = 1 << iota
+	FlagCompressed
+	FlagEndOfStream
+	// FlagRetryable 表示响应里面的错误是暂时的，幂等的方法可以重试
+	FlagRetryable
+)
+
+const (
+	// fixedHeadLength 是头部固定部分的长度：
+	// 头部长度、body 长度、请求 ID 和版本、压缩、序列化三个字节
+	fixedHeadLength = 15
+	// numOfPrefixBytes 是 Version3 帧最前面的魔数、帧类型和标记位的长度
+	numOfPrefixBytes = 4
+)
+
+// fixedHeader 是请求和响应共有的头部固定部分
+type fixedHeader struct {
+	kind       uint8
+	flags      uint8
+	headLength uint32
+	bodyLength uint32
+	requestId  uint32
+	version    uint8
+	compresser uint8
+	serializer uint8
+	// size 是固定部分在帧里面占用的字节数
+	size int
+}
+
+func (h *fixedHeader) encode(bs []byte) []byte {
+	if h.version >= Version3 {
+		binary.BigEndian.PutUint16(bs[:2], MagicNumber)
+		bs[2] = h.kind
+		bs[3] = h.flags
+		bs = bs[numOfPrefixBytes:]
+	}
+	binary.BigEndian.PutUint32(bs[:4], h.headLength)
+	binary.BigEndian.PutUint32(bs[4:8], h.bodyLength)
+	binary.BigEndian.PutUint32(bs[8:12], h.requestId)
+	bs[12] = h.version
+	bs[13] = h.compresser
+	bs[14] = h.serializer
+	return bs[fixedHeadLength:]
+}
+
+// decodeFixedHeader 只解析头部的固定部分，不检查长度是否和数据一致
+func decodeFixedHeader(data []byte) (fixedHeader, error) {
+	var h fixedHeader
+	if IsTyped(data) {
+		if len(data) < numOfPrefixBytes+fixedHeadLength {
+			return h, fmt.Errorf("%w: message is %d bytes", errs.ErrMalformedMessage, len(data))
+		}
+		h.kind = data[2]
+		h.flags = data[3]
+		data = data[numOfPrefixBytes:]
+		h.size = numOfPrefixBytes
+	} else if len(data) < fixedHeadLength {
+		return h, fmt.Errorf("%w: message is %d bytes", errs.ErrMalformedMessage, len(data))
+	}
+	h.headLength = binary.BigEndian.Uint32(data[:4])
+	h.bodyLength = binary.BigEndian.Uint32(data[4:8])
+	h.requestId = binary.BigEndian.Uint32(data[8:12])
+	h.version = data[12]
+	h.compresser = data[13]
+	h.serializer = data[14]
+	h.size += fixedHeadLength
+	return h, nil
+}
+
+// check 检查版本号，以及头部声明的长度和实际的数据长度是否一致
+func (h *fixedHeader) check(size int) error {
+	if h.version > MaxSupportedVersion {
+		return &UnsupportedVersionError{
+			MinVersion:   h.version,
+			MaxVersion:   h.version,
+			SupportedMin: MinSupportedVersion,
+			SupportedMax: MaxSupportedVersion,
+		}
+	}
+	// 带魔数的帧必须是 Version3 以上，反过来也一样
+	if (h.size > fixedHeadLength) != (h.version >= Version3) {
+		return fmt.Errorf("%w: version %d does not match frame layout", errs.ErrMalformedMessage, h.version)
+	}
+	return checkLength(h.headLength, h.bodyLength, h.size, size)
+}
+
+// IsTyped 判断 data 是不是以魔数开头的 Version3 帧
+func IsTyped(data []byte) bool {
+	return len(data) >= 2 && binary.BigEndian.Uint16(data[:2]) == MagicNumber
+}
+
+// PeekHeader 读出请求 ID 和版本号。
+// 帧无法完整解析的时候，服务端用它来回复错误
+func PeekHeader(data []byte) (requestId uint32, version uint8) {
+	h, err := decodeFixedHeader(data)
+	if err != nil {
+		return 0, 0
+	}
+	return h.requestId, h.version
+}
+
+// numOfFieldLengthBytes 是 Version2 里面字段长度前缀的字节数
+const numOfFieldLengthBytes = 4
+
+// checkLength 检查头部声明的长度和实际的数据长度是否一致
+func checkLength(headLength, bodyLength uint32, minHeadLength, size int) error {
+	if uint64(headLength) < uint64(minHeadLength) || uint64(headLength) > uint64(size) {
+		return fmt.Errorf("%w: head length %d, message is %d bytes", errs.ErrMalformedMessage, headLength, size)
+	}
+	if uint64(headLength)+uint64(bodyLength) != uint64(size) {
+		return fmt.Errorf("%w: body length %d, message is %d bytes", errs.ErrMalformedMessage, bodyLength, size)
+	}
+	return nil
+}
+
+// putField 写入带长度前缀的字段，返回剩余的部分
+func putField(cur []byte, field string) []byte {
+	binary.BigEndian.PutUint32(cur, uint32(len(field)))
+	cur = cur[numOfFieldLengthBytes:]
+	copy(cur, field)
+	return cur[len(field):]
+}
+
+// readField 读取带长度前缀的字段，返回字段和剩余的部分
+func readField(cur []byte) ([]byte, []byte, error) {
+	if len(cur) < numOfFieldLengthBytes {
+		return nil, nil, fmt.Errorf("%w: truncated field length", errs.ErrMalformedMessage)
+	}
+	length := binary.BigEndian.Uint32(cur)
+	cur = cur[numOfFieldLengthBytes:]
+	if uint64(length) > uint64(len(cur)) {
+		return nil, nil, fmt.Errorf("%w: field length %d exceeds header", errs.ErrMalformedMessage, length)
+	}
+	return cur[:length], cur[length:], nil
+}
+
+// sortedKeys 让元数据按照 key 的顺序编码，同样的请求总是编码出同样的字节
+func sortedKeys(meta map[string]string) []string {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
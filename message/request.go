@@ -2,10 +2,15 @@ package message
 
 import (
 	"bytes"
-	"encoding/binary"
+	"fmt"
+	"go-rpc/internal/errs"
 )
 
 type Request struct {
+	// Kind 和 Flags 只在 Version3 以上的帧里面编码
+	Kind  uint8
+	Flags uint8
+
 	HeadLength uint32
 	BodyLength uint32
 	RequestId  uint32
@@ -22,7 +27,17 @@ type Request struct {
 }
 
 func (req *Request) CalculateHeaderLength() {
-	req.HeadLength = 15 + uint32(len(req.ServiceName)) + 1 + uint32(len(req.MethodName)) + 1
+	if req.Version >= Version2 {
+		req.HeadLength = fixedHeadLength + numOfFieldLengthBytes*2 + uint32(len(req.ServiceName)) + uint32(len(req.MethodName))
+		for key, val := range req.Meta {
+			req.HeadLength += numOfFieldLengthBytes*2 + uint32(len(key)) + uint32(len(val))
+		}
+		if req.Version >= Version3 {
+			req.HeadLength += numOfPrefixBytes
+		}
+		return
+	}
+	req.HeadLength = fixedHeadLength + uint32(len(req.ServiceName)) + 1 + uint32(len(req.MethodName)) + 1
 	for key, val := range req.Meta {
 		req.HeadLength += uint32(len(key)+1) + uint32(len(val)+1)
 	}
@@ -35,15 +50,32 @@ func (req *Request) CalculateBodyLength() {
 func (req *Request) Encode() []byte {
 	bs := make([]byte, req.HeadLength+req.BodyLength)
 
-	binary.BigEndian.PutUint32(bs[:4], req.HeadLength)
-	binary.BigEndian.PutUint32(bs[4:8], req.BodyLength)
-	binary.BigEndian.PutUint32(bs[8:12], req.RequestId)
-	bs[12] = req.Version
-	bs[13] = req.Compresser
-	bs[14] = req.Serializer
+	cur := req.fixedHeader().encode(bs)
+	if req.Version >= Version2 {
+		cur = req.encodeHeaderV2(cur)
+	} else {
+		cur = req.encodeHeaderV1(cur)
+	}
 
-	cur := bs[15:]
+	copy(cur, req.Data)
 
+	return bs
+}
+
+func (req *Request) fixedHeader() *fixedHeader {
+	return &fixedHeader{
+		kind:       req.Kind,
+		flags:      req.Flags,
+		headLength: req.HeadLength,
+		bodyLength: req.BodyLength,
+		requestId:  req.RequestId,
+		version:    req.Version,
+		compresser: req.Compresser,
+		serializer: req.Serializer,
+	}
+}
+
+func (req *Request) encodeHeaderV1(cur []byte) []byte {
 	copy(cur, req.ServiceName)
 	cur = cur[len(req.ServiceName):]
 
@@ -56,7 +88,8 @@ func (req *Request) Encode() []byte {
 	cur[0] = '\n'
 	cur = cur[1:]
 
-	for key, val := range req.Meta {
+	for _, key := range sortedKeys(req.Meta) {
+		val := req.Meta[key]
 		copy(cur, key)
 		cur = cur[len(key):]
 
@@ -69,28 +102,70 @@ func (req *Request) Encode() []byte {
 		cur[0] = '\n'
 		cur = cur[1:]
 	}
+	return cur
+}
 
-	copy(cur, req.Data)
-
-	return bs
+func (req *Request) encodeHeaderV2(cur []byte) []byte {
+	cur = putField(cur, req.ServiceName)
+	cur = putField(cur, req.MethodName)
+	for _, key := range sortedKeys(req.Meta) {
+		cur = putField(cur, key)
+		cur = putField(cur, req.Meta[key])
+	}
+	return cur
 }
 
-func DecodeReq(data []byte) *Request {
-	req := &Request{}
+// DecodeReq 解析请求，data 必须是一个完整的帧。
+// 数据不完整或者格式不对的时候返回 error，而不是 panic
+func DecodeReq(data []byte) (*Request, error) {
+	h, err := decodeFixedHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.check(len(data)); err != nil {
+		return nil, err
+	}
+
+	req := &Request{
+		Kind:       h.kind,
+		Flags:      h.flags,
+		HeadLength: h.headLength,
+		BodyLength: h.bodyLength,
+		RequestId:  h.requestId,
+		Version:    h.version,
+		Compresser: h.compresser,
+		Serializer: h.serializer,
+	}
 
-	req.HeadLength = binary.BigEndian.Uint32(data[:4])
-	req.BodyLength = binary.BigEndian.Uint32(data[4:8])
-	req.RequestId = binary.BigEndian.Uint32(data[8:12])
-	req.Version = data[12]
-	req.Compresser = data[13]
-	req.Serializer = data[14]
+	header := data[h.size:req.HeadLength]
+	if req.Version >= Version2 {
+		err = req.decodeHeaderV2(header)
+	} else {
+		err = req.decodeHeaderV1(header)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	header := data[15:req.HeadLength]
+	if req.BodyLength != 0 {
+		req.Data = data[req.HeadLength:]
+	}
+
+	return req, nil
+}
+
+func (req *Request) decodeHeaderV1(header []byte) error {
 	index := bytes.IndexByte(header, '\n')
+	if index == -1 {
+		return fmt.Errorf("%w: missing service name", errs.ErrMalformedMessage)
+	}
 	req.ServiceName = string(header[:index])
 	header = header[index+1:]
 
 	index = bytes.IndexByte(header, '\n')
+	if index == -1 {
+		return fmt.Errorf("%w: missing method name", errs.ErrMalformedMessage)
+	}
 	req.MethodName = string(header[:index])
 	header = header[index+1:]
 
@@ -102,6 +177,9 @@ func DecodeReq(data []byte) *Request {
 			pair := header[:index]
 
 			pairIndex := bytes.IndexByte(pair, '\r')
+			if pairIndex == -1 {
+				return fmt.Errorf("%w: malformed meta", errs.ErrMalformedMessage)
+			}
 
 			key := string(pair[:pairIndex])
 			val := string(pair[pairIndex+1:])
@@ -112,10 +190,41 @@ func DecodeReq(data []byte) *Request {
 		}
 		req.Meta = meta
 	}
+	if len(header) != 0 {
+		return fmt.Errorf("%w: trailing bytes in header", errs.ErrMalformedMessage)
+	}
+	return nil
+}
 
-	if req.BodyLength != 0 {
-		req.Data = data[req.HeadLength:]
+func (req *Request) decodeHeaderV2(header []byte) error {
+	serviceName, header, err := readField(header)
+	if err != nil {
+		return err
+	}
+	req.ServiceName = string(serviceName)
+
+	methodName, header, err := readField(header)
+	if err != nil {
+		return err
 	}
+	req.MethodName = string(methodName)
 
-	return req
+	if len(header) == 0 {
+		return nil
+	}
+	meta := make(map[string]string, 4)
+	for len(header) > 0 {
+		var key, val []byte
+		key, header, err = readField(header)
+		if err != nil {
+			return err
+		}
+		val, header, err = readField(header)
+		if err != nil {
+			return err
+		}
+		meta[string(key)] = string(val)
+	}
+	req.Meta = meta
+	return nil
 }
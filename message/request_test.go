@@ -1,7 +1,11 @@
 package message
 
 import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go-rpc/internal/errs"
 	"testing"
 )
 
@@ -64,6 +68,70 @@ func TestReqDecodeEncode(t *testing.T) {
 				Data: []byte("hello world\n"),
 			},
 		},
+		{
+			name: "v2",
+			req: &Request{
+				Version:     Version2,
+				Compresser:  1,
+				Serializer:  1,
+				ServiceName: "UserService",
+				MethodName:  "GetById",
+				Meta: map[string]string{
+					"err":      "my err",
+					"trace id": "123",
+				},
+				Data: []byte("hello world"),
+			},
+		},
+		{
+			name: "v2 meta with separators",
+			req: &Request{
+				Version:     Version2,
+				Compresser:  1,
+				Serializer:  1,
+				ServiceName: "User\nService",
+				MethodName:  "Get\rById",
+				Meta: map[string]string{
+					"err\r\n":  "my\r\nerr",
+					"binary":   string([]byte{0, 1, '\r', '\n', 0xff}),
+					"":         "",
+					"trace id": "",
+				},
+				Data: []byte("hello world\n"),
+			},
+		},
+		{
+			name: "v2 no meta no data",
+			req: &Request{
+				Version:     Version2,
+				ServiceName: "UserService",
+				MethodName:  "GetById",
+			},
+		},
+		{
+			name: "v3",
+			req: &Request{
+				Kind:        KindRequest,
+				Flags:       FlagOneway | FlagCompressed,
+				Version:     Version3,
+				Compresser:  1,
+				Serializer:  1,
+				ServiceName: "UserService",
+				MethodName:  "GetById",
+				Meta: map[string]string{
+					"trace id": "123\r\n",
+				},
+				Data: []byte("hello world"),
+			},
+		},
+		{
+			name: "v3 control frame",
+			req: &Request{
+				Kind:      KindCancel,
+				RequestId: 12,
+				Version:   Version3,
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -71,8 +139,234 @@ func TestReqDecodeEncode(t *testing.T) {
 			tc.req.CalculateHeaderLength()
 			tc.req.CalculateBodyLength()
 			data := tc.req.Encode()
-			req := DecodeReq(data)
+			req, err := DecodeReq(data)
+			require.NoError(t, err)
 			require.Equal(t, tc.req, req)
 		})
 	}
 }
+
+func TestReqEncodeDeterministic(t *testing.T) {
+	for _, version := range []uint8{Version1, Version2} {
+		var want []byte
+		for i := 0; i < 10; i++ {
+			req := &Request{
+				Version:     version,
+				ServiceName: "UserService",
+				MethodName:  "GetById",
+				Meta: map[string]string{
+					"a": "1",
+					"b": "2",
+					"c": "3",
+					"d": "4",
+					"e": "5",
+				},
+			}
+			req.CalculateHeaderLength()
+			req.CalculateBodyLength()
+			data := req.Encode()
+			if want == nil {
+				want = data
+			}
+			require.Equal(t, want, data)
+		}
+	}
+}
+
+func TestDecodeReqVersion(t *testing.T) {
+	req := &Request{
+		Kind:        KindRequest,
+		Version:     Version3,
+		ServiceName: "UserService",
+		MethodName:  "GetById",
+	}
+	req.CalculateHeaderLength()
+	req.CalculateBodyLength()
+	data := req.Encode()
+	assert.True(t, IsTyped(data))
+
+	// 带魔数的帧，版本号却是 Version2
+	bs := bytes.Clone(data)
+	bs[numOfPrefixBytes+12] = Version2
+	_, err := DecodeReq(bs)
+	assert.ErrorIs(t, err, errs.ErrMalformedMessage)
+
+	// 不认识的版本
+	bs = bytes.Clone(data)
+	bs[numOfPrefixBytes+12] = MaxSupportedVersion + 1
+	_, err = DecodeReq(bs)
+	assert.Equal(t, &UnsupportedVersionError{
+		MinVersion:   MaxSupportedVersion + 1,
+		MaxVersion:   MaxSupportedVersion + 1,
+		SupportedMin: MinSupportedVersion,
+		SupportedMax: MaxSupportedVersion,
+	}, err)
+
+	id, version := PeekHeader(bs)
+	assert.Equal(t, uint32(0), id)
+	assert.Equal(t, MaxSupportedVersion+1, version)
+}
+
+func TestDecodeReqMalformedV2(t *testing.T) {
+	valid := &Request{
+		Version:     Version2,
+		ServiceName: "UserService",
+		MethodName:  "GetById",
+		Meta: map[string]string{
+			"trace id": "123",
+		},
+	}
+	valid.CalculateHeaderLength()
+	valid.CalculateBodyLength()
+	data := valid.Encode()
+
+	testCases := []struct {
+		name string
+		data func() []byte
+	}{
+		{
+			name: "service name too long",
+			data: func() []byte {
+				bs := bytes.Clone(data)
+				binary.BigEndian.PutUint32(bs[fixedHeadLength:], uint32(len(bs)))
+				return bs
+			},
+		},
+		{
+			name: "truncated field length",
+			data: func() []byte {
+				bs := bytes.Clone(data[:len(data)-len("123")-numOfFieldLengthBytes+2])
+				binary.BigEndian.PutUint32(bs[:4], uint32(len(bs)))
+				return bs
+			},
+		},
+		{
+			name: "meta without value",
+			data: func() []byte {
+				bs := bytes.Clone(data[:len(data)-len("123")-numOfFieldLengthBytes])
+				binary.BigEndian.PutUint32(bs[:4], uint32(len(bs)))
+				return bs
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DecodeReq(tc.data())
+			assert.ErrorIs(t, err, errs.ErrMalformedMessage)
+		})
+	}
+}
+
+func TestDecodeReqMalformed(t *testing.T) {
+	valid := &Request{
+		ServiceName: "UserService",
+		MethodName:  "GetById",
+		Meta: map[string]string{
+			"trace id": "123",
+		},
+		Data: []byte("hello world"),
+	}
+	valid.CalculateHeaderLength()
+	valid.CalculateBodyLength()
+	data := valid.Encode()
+
+	testCases := []struct {
+		name string
+		data func() []byte
+	}{
+		{
+			name: "empty",
+			data: func() []byte {
+				return nil
+			},
+		},
+		{
+			name: "truncated fixed header",
+			data: func() []byte {
+				return data[:10]
+			},
+		},
+		{
+			name: "truncated body",
+			data: func() []byte {
+				return data[:len(data)-1]
+			},
+		},
+		{
+			name: "head length too small",
+			data: func() []byte {
+				bs := bytes.Clone(data)
+				binary.BigEndian.PutUint32(bs[:4], 3)
+				return bs
+			},
+		},
+		{
+			name: "head length larger than data",
+			data: func() []byte {
+				bs := bytes.Clone(data)
+				binary.BigEndian.PutUint32(bs[:4], uint32(len(bs)+1))
+				return bs
+			},
+		},
+		{
+			name: "missing separator",
+			data: func() []byte {
+				bs := bytes.Clone(data)
+				bs[fixedHeadLength+len(valid.ServiceName)] = 'x'
+				bs[fixedHeadLength+len(valid.ServiceName)+len(valid.MethodName)+1] = 'x'
+				return bs
+			},
+		},
+		{
+			name: "meta without value",
+			data: func() []byte {
+				bs := bytes.Clone(data)
+				idx := bytes.IndexByte(bs, '\r')
+				bs[idx] = 'x'
+				return bs
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DecodeReq(tc.data())
+			assert.ErrorIs(t, err, errs.ErrMalformedMessage)
+		})
+	}
+}
+
+func FuzzDecodeReq(f *testing.F) {
+	req := &Request{
+		Version:     1,
+		Serializer:  1,
+		ServiceName: "UserService",
+		MethodName:  "GetById",
+		Meta: map[string]string{
+			"trace id": "123",
+		},
+		Data: []byte("hello world"),
+	}
+	req.CalculateHeaderLength()
+	req.CalculateBodyLength()
+	f.Add(req.Encode())
+	req.Version = Version2
+	req.CalculateHeaderLength()
+	f.Add(req.Encode())
+	req.Version = Version3
+	req.Kind = KindRequest
+	req.CalculateHeaderLength()
+	f.Add(req.Encode())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := DecodeReq(data)
+		if err != nil {
+			return
+		}
+		if uint32(len(req.Data)) != req.BodyLength {
+			t.Fatalf("body length %d, but got %d bytes", req.BodyLength, len(req.Data))
+		}
+	})
+}
@@ -3,9 +3,15 @@ package message
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"go-rpc/internal/errs"
 )
 
 type Response struct {
+	// Kind 和 Flags 只在 Version3 以上的帧里面编码
+	Kind  uint8
+	Flags uint8
+
 	HeadLength uint32
 	BodyLength uint32
 	RequestId  uint32
@@ -18,7 +24,14 @@ type Response struct {
 }
 
 func (res *Response) CalculateHeaderLength() {
-	res.HeadLength = 15 + uint32(len(res.Error)) + 1
+	if res.Version >= Version2 {
+		res.HeadLength = fixedHeadLength + numOfFieldLengthBytes + uint32(len(res.Error))
+		if res.Version >= Version3 {
+			res.HeadLength += numOfPrefixBytes
+		}
+		return
+	}
+	res.HeadLength = fixedHeadLength + uint32(len(res.Error)) + 1
 }
 
 func (res *Response) CalculateBodyLength() {
@@ -28,46 +41,81 @@ func (res *Response) CalculateBodyLength() {
 func (res *Response) Encode() []byte {
 	bs := make([]byte, res.HeadLength+res.BodyLength)
 
-	binary.BigEndian.PutUint32(bs[0:4], res.HeadLength)
-	binary.BigEndian.PutUint32(bs[4:8], res.BodyLength)
-	binary.BigEndian.PutUint32(bs[8:12], res.RequestId)
-	bs[12] = res.Version
-	bs[13] = res.Compresser
-	bs[14] = res.Serializer
-
-	cur := bs[15:]
-
-	copy(cur, res.Error)
-	cur = cur[len(res.Error):]
-
-	cur[0] = '\n'
-	cur = cur[1:]
+	cur := res.fixedHeader().encode(bs)
+	if res.Version >= Version2 {
+		binary.BigEndian.PutUint32(cur, uint32(len(res.Error)))
+		cur = cur[numOfFieldLengthBytes:]
+		copy(cur, res.Error)
+		cur = cur[len(res.Error):]
+	} else {
+		copy(cur, res.Error)
+		cur = cur[len(res.Error):]
+
+		cur[0] = '\n'
+		cur = cur[1:]
+	}
 
 	copy(cur, res.Data)
 
 	return bs
 }
 
-func DecodeRes(data []byte) *Response {
-	res := &Response{}
+func (res *Response) fixedHeader() *fixedHeader {
+	return &fixedHeader{
+		kind:       res.Kind,
+		flags:      res.Flags,
+		headLength: res.HeadLength,
+		bodyLength: res.BodyLength,
+		requestId:  res.RequestId,
+		version:    res.Version,
+		compresser: res.Compresser,
+		serializer: res.Serializer,
+	}
+}
+
+// DecodeRes 解析响应，data 必须是一个完整的帧
+func DecodeRes(data []byte) (*Response, error) {
+	h, err := decodeFixedHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.check(len(data)); err != nil {
+		return nil, err
+	}
 
-	res.HeadLength = binary.BigEndian.Uint32(data[0:4])
-	res.BodyLength = binary.BigEndian.Uint32(data[4:8])
-	res.RequestId = binary.BigEndian.Uint32(data[8:12])
-	res.Version = data[12]
-	res.Compresser = data[13]
-	res.Serializer = data[14]
+	res := &Response{
+		Kind:       h.kind,
+		Flags:      h.flags,
+		HeadLength: h.headLength,
+		BodyLength: h.bodyLength,
+		RequestId:  h.requestId,
+		Version:    h.version,
+		Compresser: h.compresser,
+		Serializer: h.serializer,
+	}
 
-	cur := data[15:res.HeadLength]
-	index := bytes.IndexByte(cur, '\n')
+	cur := data[h.size:res.HeadLength]
+	var resErr []byte
+	if res.Version >= Version2 {
+		resErr, _, err = readField(cur)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		index := bytes.IndexByte(cur, '\n')
+		if index == -1 {
+			return nil, fmt.Errorf("%w: missing error separator", errs.ErrMalformedMessage)
+		}
+		resErr = cur[:index]
+	}
 
-	if len(cur[:index]) != 0 {
-		res.Error = cur[:index]
+	if len(resErr) != 0 {
+		res.Error = resErr
 	}
 
 	if res.BodyLength != 0 {
 		res.Data = data[res.HeadLength:]
 	}
 
-	return res
+	return res, nil
 }
@@ -1,7 +1,11 @@
 package message
 
 import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go-rpc/internal/errs"
 	"testing"
 )
 
@@ -48,6 +52,45 @@ func TestResDecodeEncode(t *testing.T) {
 				Data:       []byte("hello world\n"),
 			},
 		},
+		{
+			name: "v2 error with \n",
+			req: &Response{
+				Version:    Version2,
+				Compresser: 1,
+				Serializer: 1,
+				Error:      []byte("my\nerror"),
+				Data:       []byte("hello world\n"),
+			},
+		},
+		{
+			name: "v2 no error",
+			req: &Response{
+				Version:    Version2,
+				Compresser: 1,
+				Serializer: 1,
+				Data:       []byte("hello world"),
+			},
+		},
+		{
+			name: "v3",
+			req: &Response{
+				Kind:       KindResponse,
+				Flags:      FlagEndOfStream,
+				RequestId:  12,
+				Version:    Version3,
+				Compresser: 1,
+				Serializer: 1,
+				Error:      []byte("my\nerror"),
+				Data:       []byte("hello world"),
+			},
+		},
+		{
+			name: "v3 control frame",
+			req: &Response{
+				Kind:    KindGoAway,
+				Version: Version3,
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -55,8 +98,90 @@ func TestResDecodeEncode(t *testing.T) {
 			tc.req.CalculateHeaderLength()
 			tc.req.CalculateBodyLength()
 			data := tc.req.Encode()
-			req := DecodeRes(data)
+			req, err := DecodeRes(data)
+			require.NoError(t, err)
 			require.Equal(t, tc.req, req)
 		})
 	}
 }
+
+func TestDecodeResMalformed(t *testing.T) {
+	valid := &Response{
+		Error: []byte("my error"),
+		Data:  []byte("hello world"),
+	}
+	valid.CalculateHeaderLength()
+	valid.CalculateBodyLength()
+	data := valid.Encode()
+
+	testCases := []struct {
+		name string
+		data func() []byte
+	}{
+		{
+			name: "empty",
+			data: func() []byte {
+				return nil
+			},
+		},
+		{
+			name: "truncated body",
+			data: func() []byte {
+				return data[:len(data)-1]
+			},
+		},
+		{
+			name: "head length larger than data",
+			data: func() []byte {
+				bs := bytes.Clone(data)
+				binary.BigEndian.PutUint32(bs[:4], uint32(len(bs)+1))
+				return bs
+			},
+		},
+		{
+			name: "missing separator",
+			data: func() []byte {
+				bs := bytes.Clone(data)
+				bs[fixedHeadLength+len(valid.Error)] = 'x'
+				return bs
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DecodeRes(tc.data())
+			assert.ErrorIs(t, err, errs.ErrMalformedMessage)
+		})
+	}
+}
+
+func FuzzDecodeRes(f *testing.F) {
+	res := &Response{
+		Version:    1,
+		Serializer: 1,
+		Error:      []byte("my error"),
+		Data:       []byte("hello world"),
+	}
+	res.CalculateHeaderLength()
+	res.CalculateBodyLength()
+	f.Add(res.Encode())
+	res.Version = Version2
+	res.CalculateHeaderLength()
+	f.Add(res.Encode())
+	res.Version = Version3
+	res.Kind = KindResponse
+	res.CalculateHeaderLength()
+	f.Add(res.Encode())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		res, err := DecodeRes(data)
+		if err != nil {
+			return
+		}
+		if uint32(len(res.Data)) != res.BodyLength {
+			t.Fatalf("body length %d, but got %d bytes", res.BodyLength, len(res.Data))
+		}
+	})
+}
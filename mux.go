@@ -0,0 +1,234 @@
+package go_rpc
+
+import (
+	"go-rpc/message"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultSniffTimeout 是等待连接发送最开始几个字节的默认时间
+const DefaultSniffTimeout = time.Second * 5
+
+// sniffLength 是判断协议需要的字节数
+const sniffLength = 4
+
+// Mux 让同一个端口同时提供 go-rpc、simple-rpc 和 HTTP 服务。
+// 它读取每个连接最开始的几个字节判断协议，然后把连接交给对应的 listener：
+//   - go-rpc 的 Version3 帧以魔数开头，之前的版本以头部长度开头，前四个字节不全是 0
+//   - simple-rpc 以 8 个字节的长度开头，消息不会超过 4GB，所以前四个字节都是 0
+//   - HTTP 以大写的请求方法开头，包括 HTTP/2 的 PRI
+//
+// 读过的字节会在连接上重新读出来。认不出来的连接，以及没有取过 listener 的协议的连接会被关闭，
+// 等待 sniffTimeout 还没有被 Accept 取走的连接也会被关闭。
+// 分出来的连接不能直接读取 fd，所以 go-rpc 的 Server 开启了 event loop 也不会使用它们。
+// TLS 连接在握手之前没有办法区分，Mux 只能用在明文的端口上
+type Mux struct {
+	root         net.Listener
+	sniffTimeout time.Duration
+
+	mutex     sync.Mutex
+	listeners [numOfMuxProtocols]*muxListener
+}
+
+type MuxOption func(m *Mux)
+
+// MuxWithSniffTimeout 设置等待连接发送数据的时间，超时没有发送足够数据的连接会被关闭
+func MuxWithSniffTimeout(timeout time.Duration) MuxOption {
+	return func(m *Mux) {
+		m.sniffTimeout = timeout
+	}
+}
+
+func NewMux(listener net.Listener, opts ...MuxOption) *Mux {
+	m := &Mux{
+		root:         listener,
+		sniffTimeout: DefaultSniffTimeout,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+type muxProtocol int
+
+const (
+	muxUnknown muxProtocol = iota - 1
+	muxRPC
+	muxSimpleRPC
+	muxHTTP
+	numOfMuxProtocols
+)
+
+// RPC 返回 go-rpc 的连接，交给 Server.Serve
+func (m *Mux) RPC() net.Listener {
+	return m.listener(muxRPC)
+}
+
+// SimpleRPC 返回 simple-rpc 的连接，交给 simple_rpc.Server.Serve
+func (m *Mux) SimpleRPC() net.Listener {
+	return m.listener(muxSimpleRPC)
+}
+
+// HTTP 返回 HTTP 的连接，交给 http.Server.Serve
+func (m *Mux) HTTP() net.Listener {
+	return m.listener(muxHTTP)
+}
+
+func (m *Mux) listener(p muxProtocol) net.Listener {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.listeners[p] == nil {
+		m.listeners[p] = newMuxListener(m.root.Addr())
+	}
+	return m.listeners[p]
+}
+
+// Serve 接收连接并且分发它们，直到 listener 被关闭。暂时的错误等待一会之后重试。
+// 返回之前关闭所有分出来的 listener，使用它们的服务也会退出
+func (m *Mux) Serve() error {
+	defer m.closeListeners()
+	var backoff acceptBackoff
+	for {
+		conn, err := m.root.Accept()
+		if err != nil {
+			if isTemporaryAcceptErr(err) {
+				backoff.wait()
+				continue
+			}
+			return err
+		}
+		backoff.reset()
+		go m.dispatch(conn)
+	}
+}
+
+// Close 关闭 listener，已经分发出去的连接不受影响
+func (m *Mux) Close() error {
+	return m.root.Close()
+}
+
+func (m *Mux) closeListeners() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, l := range m.listeners {
+		if l != nil {
+			_ = l.Close()
+		}
+	}
+}
+
+func (m *Mux) dispatch(conn net.Conn) {
+	var head [sniffLength]byte
+	_ = conn.SetReadDeadline(time.Now().Add(m.sniffTimeout))
+	_, err := io.ReadFull(conn, head[:])
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	p := sniff(head)
+	if p == muxUnknown {
+		_ = conn.Close()
+		return
+	}
+	m.mutex.Lock()
+	l := m.listeners[p]
+	m.mutex.Unlock()
+	if l == nil {
+		_ = conn.Close()
+		return
+	}
+	l.push(&sniffedConn{Conn: conn, head: head[:]}, m.sniffTimeout)
+}
+
+// sniff 根据连接最开始的几个字节判断协议
+func sniff(head [sniffLength]byte) muxProtocol {
+	switch {
+	case message.IsTyped(head[:]):
+		return muxRPC
+	case head == [sniffLength]byte{}:
+		return muxSimpleRPC
+	case head[0] == 0:
+		// 老版本的帧以头部长度开头，头部不会超过 16MB
+		return muxRPC
+	case head[0] >= 'A' && head[0] <= 'Z':
+		return muxHTTP
+	default:
+		return muxUnknown
+	}
+}
+
+// muxListener 是 Mux 分出来的 listener，Accept 返回属于这个协议的连接
+type muxListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newMuxListener(addr net.Addr) *muxListener {
+	return &muxListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// push 等待 Accept 取走连接。listener 已经关闭，或者超过 timeout 还没有被取走的时候关闭连接，
+// 没有人调用 Accept 的时候不会一直占着 goroutine 和 fd
+func (l *muxListener) push(conn net.Conn, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		_ = conn.Close()
+	case <-timer.C:
+		_ = conn.Close()
+	}
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *muxListener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		close(l.closed)
+		err = nil
+	})
+	return err
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return l.addr
+}
+
+// sniffedConn 先读出判断协议的时候读过的字节，再继续从连接读取
+type sniffedConn struct {
+	net.Conn
+	head []byte
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	if len(c.head) > 0 {
+		n := copy(p, c.head)
+		c.head = c.head[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *sniffedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,194 @@
+package go_rpc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-rpc/message"
+	simple_rpc "go-rpc/simple-rpc"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMux(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	mux := NewMux(l, MuxWithSniffTimeout(time.Millisecond*200))
+	addr := l.Addr().String()
+
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "go-rpc"})
+	go func() {
+		_ = server.Serve(mux.RPC())
+	}()
+	defer server.Close()
+	simpleServer := simple_rpc.NewServer()
+	simpleServer.RegisterService(&simple_rpc.UserServiceServer{})
+	go func() {
+		_ = simpleServer.Serve(mux.SimpleRPC())
+	}()
+	handler := http.NewServeMux()
+	handler.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	handler.Handle("/rpc", server)
+	go func() {
+		_ = http.Serve(mux.HTTP(), handler)
+	}()
+	go func() {
+		_ = mux.Serve()
+	}()
+	defer mux.Close()
+
+	// 一直不发送数据的连接不影响其它连接
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+
+	testCases := []struct {
+		name string
+		call func(t *testing.T) string
+		want string
+	}{
+		{
+			name: "go-rpc",
+			call: func(t *testing.T) string {
+				usClient := &UserService{}
+				client, er := NewClient(addr)
+				require.NoError(t, er)
+				require.NoError(t, client.InitService(usClient))
+				resp, er := usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+				require.NoError(t, er)
+				return resp.Msg
+			},
+			want: "go-rpc",
+		},
+		{
+			name: "go-rpc version1",
+			call: func(t *testing.T) string {
+				conn, er := net.Dial("tcp", addr)
+				require.NoError(t, er)
+				cc := newClientConn(conn, NewFrameReader(conn, DefaultMaxHeaderSize, DefaultMaxBodySize))
+				defer cc.close(nil)
+				resp, er := cc.send(context.Background(), newGetByIdReq(1, message.Version1))
+				require.NoError(t, er)
+				return string(resp.Data)
+			},
+			want: `{"Msg":"go-rpc"}`,
+		},
+		{
+			name: "go-rpc over http",
+			call: func(t *testing.T) string {
+				usClient := &UserService{}
+				client, er := NewClient("http://" + addr + "/rpc")
+				require.NoError(t, er)
+				require.NoError(t, client.InitService(usClient))
+				resp, er := usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+				require.NoError(t, er)
+				return resp.Msg
+			},
+			want: "go-rpc",
+		},
+		{
+			name: "simple-rpc",
+			call: func(t *testing.T) string {
+				client, er := simple_rpc.NewClient(addr)
+				require.NoError(t, er)
+				arg, er := json.Marshal(&simple_rpc.GetByIdReq{Id: 1})
+				require.NoError(t, er)
+				resp, er := client.Invoke(context.Background(), &simple_rpc.Request{
+					ServiceName: "user-service",
+					MethodName:  "GetById",
+					Arg:         arg,
+				})
+				require.NoError(t, er)
+				return string(resp.Data)
+			},
+			want: `{"Msg":"hello, world"}`,
+		},
+		{
+			name: "http",
+			call: func(t *testing.T) string {
+				resp, er := http.Get("http://" + addr + "/healthz")
+				require.NoError(t, er)
+				defer resp.Body.Close()
+				data, er := io.ReadAll(resp.Body)
+				require.NoError(t, er)
+				return string(data)
+			},
+			want: "ok",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.call(t))
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		conn, er := net.Dial("tcp", addr)
+		require.NoError(t, er)
+		defer conn.Close()
+		// TLS 的 ClientHello
+		_, er = conn.Write([]byte{0x16, 0x03, 0x01, 0x00})
+		require.NoError(t, er)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, er = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, er)
+	})
+
+	t.Run("sniff timeout", func(t *testing.T) {
+		_ = idle.SetReadDeadline(time.Now().Add(time.Second))
+		_, er := idle.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, er)
+	})
+}
+
+func TestMux_NotAccepted(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	flaky := &flakyListener{Listener: l}
+	flaky.failures.Store(3)
+	mux := NewMux(flaky, MuxWithSniffTimeout(time.Millisecond*100))
+	// 取了 listener 但是一直不调用 Accept
+	_ = mux.HTTP()
+	go func() {
+		_ = mux.Serve()
+	}()
+	defer mux.Close()
+
+	// 暂时的错误过去之后继续分发连接，没有被取走的连接超时之后关闭
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET "))
+	require.NoError(t, err)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSniff(t *testing.T) {
+	testCases := []struct {
+		name string
+		head [sniffLength]byte
+		want muxProtocol
+	}{
+		{name: "version3", head: [sniffLength]byte{0xC0, 0xDE, 1, 0}, want: muxRPC},
+		{name: "version1", head: [sniffLength]byte{0, 0, 0, 30}, want: muxRPC},
+		{name: "simple-rpc", head: [sniffLength]byte{}, want: muxSimpleRPC},
+		{name: "http/1.1", head: [sniffLength]byte{'G', 'E', 'T', ' '}, want: muxHTTP},
+		{name: "h2c", head: [sniffLength]byte{'P', 'R', 'I', ' '}, want: muxHTTP},
+		{name: "tls", head: [sniffLength]byte{0x16, 0x03, 0x01, 0x00}, want: muxUnknown},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, sniff(tc.head))
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package go_rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"time"
+)
+
+// tlsHandshakeTimeout 限制服务端等待 TLS 握手的时间
+const tlsHandshakeTimeout = time.Second * 10
+
+// Peer 是调用方的信息，服务端的方法可以通过 PeerFromContext 拿到它来做鉴权
+type Peer struct {
+	Addr net.Addr
+	// TLS 为 nil 表示连接没有使用 TLS
+	TLS *tls.ConnectionState
+
+	// 下面的字段来自客户端证书，只有在证书通过校验的时候才会设置
+	Certificate *x509.Certificate
+	Subject     pkix.Name
+	DNSNames    []string
+	URIs        []*url.URL
+	// SPIFFEID 是证书里面第一个 spiffe:// 开头的 URI SAN
+	SPIFFEID string
+
+	// Credentials 是 Unix domain socket 另一端进程的身份，其它连接为 nil
+	Credentials *UnixCredentials
+}
+
+// UnixCredentials 是对端进程的身份，目前只有 Linux 支持
+type UnixCredentials struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+type peerKey struct{}
+
+func CtxWithPeer(ctx context.Context, p *Peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
+
+// newPeer 收集连接另一端的信息。TLS 连接会在这里完成握手
+func newPeer(conn net.Conn) (*Peer, error) {
+	p := &Peer{
+		Addr: conn.RemoteAddr(),
+	}
+	// TLS 和共享内存的连接下面都是 Unix domain socket 的时候也能拿到对方的身份。
+	// wss 的 TLS 连接在 WebSocket 下面，也要一层一层找
+	var tlsConn *tls.Conn
+	raw := conn
+	for {
+		if c, isTLS := raw.(*tls.Conn); isTLS && tlsConn == nil {
+			tlsConn = c
+		}
+		wrapper, isWrapper := raw.(interface{ NetConn() net.Conn })
+		if !isWrapper {
+			break
+		}
+		raw = wrapper.NetConn()
+	}
+	if unixConn, isUnix := raw.(*net.UnixConn); isUnix {
+		// 拿不到身份不影响连接，只是没有办法根据身份鉴权
+		p.Credentials, _ = unixCredentials(unixConn)
+	}
+	if tlsConn == nil {
+		return p, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	p.setTLS(&state)
+	return p, nil
+}
+
+// setTLS 记录 TLS 连接的状态和校验通过的客户端证书
+func (p *Peer) setTLS(state *tls.ConnectionState) {
+	p.TLS = state
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		cert := state.VerifiedChains[0][0]
+		p.Certificate = cert
+		p.Subject = cert.Subject
+		p.DNSNames = cert.DNSNames
+		p.URIs = cert.URIs
+		for _, uri := range cert.URIs {
+			if uri.Scheme == "spiffe" {
+				p.SPIFFEID = uri.String()
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package go_rpc
+
+import (
+	"net"
+	"syscall"
+)
+
+// unixCredentials 通过 SO_PEERCRED 读取 Unix domain socket 另一端进程的身份。
+// 内核记录的是对端 connect 时候的身份，对端没有办法伪造
+func unixCredentials(conn *net.UnixConn) (*UnixCredentials, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		ucred *syscall.Ucred
+		er    error
+	)
+	err = raw.Control(func(fd uintptr) {
+		ucred, er = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if er != nil {
+		return nil, er
+	}
+	return &UnixCredentials{
+		Pid: ucred.Pid,
+		Uid: ucred.Uid,
+		Gid: ucred.Gid,
+	}, nil
+}
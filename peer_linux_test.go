@@ -0,0 +1,83 @@
+//go:build linux
+
+package go_rpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "go-rpc.sock")
+	testCases := []struct {
+		name       string
+		addr       string
+		clientAddr string
+	}{
+		{
+			name: "path",
+			addr: path,
+			// 客户端和服务端要使用同一个文件
+			clientAddr: "unix://" + path,
+		},
+		{
+			name:       "abstract",
+			addr:       fmt.Sprintf("@go-rpc-test-%d", os.Getpid()),
+			clientAddr: fmt.Sprintf("unix:@go-rpc-test-%d", os.Getpid()),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer()
+			service := &UserServiceServerPeer{}
+			server.RegisterService(service)
+			go func() {
+				_ = server.Start("unix", tc.addr)
+			}()
+			defer server.Close()
+			require.Eventually(t, func() bool {
+				return server.Addr() != nil
+			}, time.Second, time.Millisecond*10)
+
+			usClient := &UserService{}
+			client, err := NewClient(tc.clientAddr)
+			require.NoError(t, err)
+			require.NoError(t, client.InitService(usClient))
+			_, err = usClient.GetById(context.Background(), &GetByIdReq{Id: 123})
+			require.NoError(t, err)
+
+			cred := service.peer.Credentials
+			require.NotNil(t, cred)
+			assert.Equal(t, int32(os.Getpid()), cred.Pid)
+			assert.Equal(t, uint32(os.Getuid()), cred.Uid)
+			assert.Equal(t, uint32(os.Getgid()), cred.Gid)
+		})
+	}
+}
+
+func TestListenUnix_StaleSocket(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "go-rpc.sock")
+	l, err := listenUnix(addr)
+	require.NoError(t, err)
+
+	// 还有进程在监听的时候不能删掉文件
+	_, err = listenUnix(addr)
+	assert.Error(t, err)
+
+	// 模拟进程异常退出留下来的 socket 文件
+	l.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	require.NoError(t, l.Close())
+	_, err = os.Stat(addr)
+	require.NoError(t, err)
+
+	l, err = listenUnix(addr)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package go_rpc
+
+import (
+	"errors"
+	"net"
+)
+
+func unixCredentials(conn *net.UnixConn) (*UnixCredentials, error) {
+	return nil, errors.New("go-rpc: SO_PEERCRED is only supported on linux")
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"go-rpc/message"
 	"go-rpc/serialize"
+	"maps"
 	"reflect"
 	"strconv"
 )
@@ -44,7 +45,17 @@ func setFuncField(service Service, p Proxy, s serialize.Serializer) error {
 		fn := reflect.MakeFunc(fieldTyp.Type, func(args []reflect.Value) (results []reflect.Value) {
 			retVal := reflect.New(fieldTyp.Type.Out(0).Elem())
 			ctx := args[0].Interface().(context.Context)
-			reqData, err := s.Encode(args[1].Interface())
+			opts := callOptionsFromContext(ctx)
+			serializer := s
+			if opts.serializer != nil {
+				serializer = opts.serializer
+			}
+			if opts.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+				defer cancel()
+			}
+			reqData, err := serializer.Encode(args[1].Interface())
 			if err != nil {
 				return []reflect.Value{retVal, reflect.ValueOf(err)}
 			}
@@ -52,18 +63,16 @@ func setFuncField(service Service, p Proxy, s serialize.Serializer) error {
 				ServiceName: service.Name(),
 				MethodName:  fieldTyp.Name,
 				Data:        reqData,
-				Serializer:  s.Code(),
+				Serializer:  serializer.Code(),
 			}
 
 			//
-			meta := make(map[string]string, 2)
+			meta := make(map[string]string, 2+len(opts.metadata))
+			maps.Copy(meta, opts.metadata)
 
 			if deadline, ok := ctx.Deadline(); ok {
 				meta["deadline"] = strconv.FormatInt(deadline.UnixMilli(), 10)
 			}
-			if isOneway(ctx) {
-				meta["one-way"] = "true"
-			}
 			req.Meta = meta
 
 			resp, err := p.Invoke(ctx, req)
@@ -77,7 +86,7 @@ func setFuncField(service Service, p Proxy, s serialize.Serializer) error {
 			}
 
 			if len(resp.Data) > 0 {
-				err = s.Decode(resp.Data, retVal.Interface())
+				err = serializer.Decode(resp.Data, retVal.Interface())
 				if err != nil {
 					// 反序列化的 error
 					return []reflect.Value{retVal, reflect.ValueOf(err)}
@@ -0,0 +1,203 @@
+package go_rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// listenFdsEnv 告诉新的进程继承了多少个 listener。
+// 它们从 fd 3 开始依次排列，最后一个 fd 是通知老进程已经准备好的管道
+const listenFdsEnv = "GO_RPC_LISTEN_FDS"
+
+// listenReusePort 用 SO_REUSEPORT 在同一个地址上创建 n 个 listener。
+// 端口是 0 的时候，后面的 listener 使用第一个 listener 分配到的端口
+func listenReusePort(network, addr string, n int) ([]net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		listener, err := lc.Listen(context.Background(), network, addr)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+		addr = listener.Addr().String()
+	}
+	return listeners, nil
+}
+
+var inherited struct {
+	once      sync.Once
+	mutex     sync.Mutex
+	listeners []net.Listener
+	ready     *os.File
+}
+
+// loadInherited 读取从老进程继承的 listener，只在第一次调用的时候读取。
+// 读取之后删除环境变量，避免它再传给这个进程启动的其它进程
+func loadInherited() {
+	inherited.once.Do(func() {
+		n, err := strconv.Atoi(os.Getenv(listenFdsEnv))
+		if err != nil || n <= 0 {
+			return
+		}
+		_ = os.Unsetenv(listenFdsEnv)
+		for i := 0; i < n; i++ {
+			f := os.NewFile(uintptr(3+i), "listener")
+			listener, er := net.FileListener(f)
+			// FileListener 会复制一个 fd，原来的可以关掉
+			_ = f.Close()
+			if er == nil {
+				inherited.listeners = append(inherited.listeners, listener)
+			}
+		}
+		inherited.ready = os.NewFile(uintptr(3+n), "ready")
+	})
+}
+
+// inheritedListeners 取出地址匹配的继承来的 listener
+func inheritedListeners(network, addr string) []net.Listener {
+	loadInherited()
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+	var res []net.Listener
+	rest := inherited.listeners[:0]
+	for _, listener := range inherited.listeners {
+		if matchAddr(listener.Addr(), network, addr) {
+			res = append(res, listener)
+		} else {
+			rest = append(rest, listener)
+		}
+	}
+	inherited.listeners = rest
+	return res
+}
+
+// matchAddr 判断 listener 的地址是不是 Start 想要监听的地址。
+// 端口是 0 或者 IP 没有指定的时候，只比较其它部分
+func matchAddr(got net.Addr, network, addr string) bool {
+	gotTCP, ok := got.(*net.TCPAddr)
+	if !ok {
+		return got.Network() == network && got.String() == addr
+	}
+	want, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return false
+	}
+	return (want.Port == 0 || want.Port == gotTCP.Port) &&
+		(want.IP == nil || want.IP.IsUnspecified() || want.IP.Equal(gotTCP.IP))
+}
+
+// notifyRestartReady 告诉启动这个进程的老进程，新的进程已经开始监听了。
+// 老进程收到通知之后就不再接收连接，这时候还没有被取走的 listener 不会再有人使用，
+// 关闭它们，避免连接一直在内核的队列里面等待
+func notifyRestartReady() {
+	loadInherited()
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+	if inherited.ready != nil {
+		_, _ = inherited.ready.Write([]byte{1})
+		_ = inherited.ready.Close()
+		inherited.ready = nil
+	}
+	for _, listener := range inherited.listeners {
+		_ = listener.Close()
+	}
+	inherited.listeners = nil
+}
+
+// Restart 用同样的命令行参数启动一个新的进程，把正在监听的 socket 交给它。
+// 新的进程调用 Start 的时候会直接使用这些 socket，所以重启的过程中不会拒绝新的连接。
+// 新的进程开始监听之后，当前进程调用 Shutdown 等待正在执行的请求结束，
+// Restart 返回之后调用者应该退出进程。
+// 新的进程启动失败或者 ctx 过期的时候返回错误，当前进程继续提供服务
+func (s *Server) Restart(ctx context.Context) error {
+	files, err := s.listenerFiles()
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", listenFdsEnv, len(files)))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	err = cmd.Start()
+	// 写的一端只留给新的进程，它退出的时候读就会返回 EOF
+	_ = w.Close()
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		_, er := r.Read(make([]byte, 1))
+		ready <- er
+	}()
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("go-rpc: new process is not ready: %w", err)
+	}
+	_ = cmd.Process.Release()
+
+	s.mutex.Lock()
+	for _, raw := range s.listeners {
+		// socket 文件现在属于新的进程了
+		if ul, ok := raw.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	s.mutex.Unlock()
+	return s.Shutdown(ctx)
+}
+
+// listenerFiles 复制所有 listener 的 fd
+func (s *Server) listenerFiles() ([]*os.File, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.listeners) == 0 {
+		return nil, errors.New("go-rpc: no listener to hand off")
+	}
+	files := make([]*os.File, 0, len(s.listeners))
+	for _, raw := range s.listeners {
+		filer, ok := raw.(interface{ File() (*os.File, error) })
+		if !ok {
+			return files, fmt.Errorf("go-rpc: cannot hand off %s listener", raw.Addr().Network())
+		}
+		f, err := filer.File()
+		if err != nil {
+			return files, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
@@ -0,0 +1,132 @@
+package go_rpc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// TestServer_Restart 会用同样的参数重新执行测试程序，新的进程只提供服务，不跑测试
+	if os.Getenv(listenFdsEnv) != "" {
+		runRestartChild()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestServer_Restart(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServerProcess{})
+	go func() {
+		_ = server.Start("tcp", "127.0.0.1:0")
+	}()
+	require.Eventually(t, func() bool {
+		return server.Addr() != nil
+	}, time.Second, time.Millisecond*10)
+	addr := server.Addr().String()
+
+	usClient := &UserService{}
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	require.NoError(t, client.InitService(usClient))
+	resp, err := usClient.GetById(context.Background(), &GetByIdReq{})
+	require.NoError(t, err)
+	parent := resp.Msg
+	assert.Equal(t, strconv.Itoa(os.Getpid()), parent)
+
+	// 正在执行的请求由老进程处理完
+	respCh := make(chan string, 1)
+	go func() {
+		res, er := usClient.GetById(context.Background(), &GetByIdReq{Id: 30})
+		if er != nil {
+			respCh <- er.Error()
+			return
+		}
+		respCh <- res.Msg
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	require.NoError(t, server.Restart(ctx))
+	assert.Equal(t, parent, <-respCh)
+
+	// 老进程已经不再接收连接，新的连接都由新的进程处理
+	client, err = NewClient(addr)
+	require.NoError(t, err)
+	require.NoError(t, client.InitService(usClient))
+	resp, err = usClient.GetById(context.Background(), &GetByIdReq{})
+	require.NoError(t, err)
+	assert.NotEqual(t, parent, resp.Msg)
+
+	// 让新的进程退出
+	_, _ = usClient.GetById(context.Background(), &GetByIdReq{Id: -1})
+}
+
+func TestNotifyRestartReady(t *testing.T) {
+	loadInherited()
+	claimed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer claimed.Close()
+	unclaimed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer unclaimed.Close()
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	inherited.mutex.Lock()
+	inherited.listeners = []net.Listener{claimed, unclaimed}
+	inherited.ready = w
+	inherited.mutex.Unlock()
+
+	assert.Equal(t, []net.Listener{claimed}, inheritedListeners("tcp", claimed.Addr().String()))
+	notifyRestartReady()
+	n, err := r.Read(make([]byte, 1))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// 没有被取走的 listener 已经关闭，取走的不受影响
+	_ = unclaimed.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+	_, err = unclaimed.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+	_, err = net.Dial("tcp", claimed.Addr().String())
+	assert.NoError(t, err)
+	assert.Empty(t, inheritedListeners("tcp", unclaimed.Addr().String()))
+}
+
+func runRestartChild() {
+	// 无论如何都不要留下进程
+	time.AfterFunc(time.Second*10, func() {
+		os.Exit(0)
+	})
+	server := NewServer()
+	server.RegisterService(&UserServiceServerProcess{})
+	_ = server.Start("tcp", "127.0.0.1:0")
+}
+
+// UserServiceServerProcess 返回处理请求的进程的 pid。
+// Id 是执行的时间，单位是 10ms，Id 为 -1 的时候退出进程
+type UserServiceServerProcess struct {
+}
+
+func (u *UserServiceServerProcess) GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	if req.Id < 0 {
+		time.AfterFunc(time.Millisecond*100, func() {
+			os.Exit(0)
+		})
+	}
+	time.Sleep(time.Duration(req.Id) * time.Millisecond * 10)
+	return &GetByIdResp{
+		Msg: strconv.Itoa(os.Getpid()),
+	}, nil
+}
+
+func (u *UserServiceServerProcess) Name() string {
+	return "user-service"
+}
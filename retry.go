@@ -0,0 +1,143 @@
+package go_rpc
+
+import (
+	"context"
+	"errors"
+	"go-rpc/internal/errs"
+	"go-rpc/message"
+	"maps"
+	"math/rand/v2"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy 是客户端的重试策略。
+// 只有幂等的方法才会重试，并且只重试连接被拒绝、服务端正在退出，以及服务端通过 Retryable 标记为可以重试的错误。
+// 每次尝试的序号放在元数据的 attempt 里面，服务端可以通过 MetadataFromContext 读取
+type RetryPolicy struct {
+	// MaxAttempts 是最多尝试的次数，包括第一次，小于 2 的时候不重试
+	MaxAttempts int
+	// InitialBackoff 是第一次重试之前等待的时间，之后每次翻倍，并且加上随机抖动。
+	// MaxBackoff 大于 0 的时候限制等待的最长时间
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// PerAttemptTimeout 是每次尝试的超时时间，超时之后可以重试。
+	// 为 0 的时候只受 context 控制，context 的 deadline 总是限制所有尝试加起来的时间
+	PerAttemptTimeout time.Duration
+	// IdempotentMethods 是幂等的方法，格式是 服务名.方法名，例如 user-service.GetById。
+	// 单次调用也可以通过 CallWithIdempotent 标记
+	IdempotentMethods []string
+}
+
+// ClientWithRetryPolicy 设置重试策略，默认不重试
+func ClientWithRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.retryPolicy = policy
+		c.idempotent = make(map[string]bool, len(policy.IdempotentMethods))
+		for _, method := range policy.IdempotentMethods {
+			c.idempotent[method] = true
+		}
+	}
+}
+
+// Retryable 把 err 标记为可以重试的错误，服务返回它的时候，客户端会重试幂等的方法。
+// 返回的错误信息和 err 一样
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err}
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() []error {
+	return []error{e.err, errs.ErrRetryable}
+}
+
+func (c *Client) isIdempotent(ctx context.Context, req *message.Request) bool {
+	return callOptionsFromContext(ctx).idempotent || c.idempotent[req.ServiceName+"."+req.MethodName]
+}
+
+// invokeWithRetry 按照重试策略发送请求，返回最后一次尝试的结果
+func (c *Client) invokeWithRetry(ctx context.Context, req *message.Request) (*message.Response, error) {
+	policy := c.retryPolicy
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		resp, err := c.invokeAttempt(ctx, req, attempt)
+		if attempt >= policy.MaxAttempts || ctx.Err() != nil || !retryable(resp, err) {
+			return resp, err
+		}
+		wait := jitter(backoff)
+		// 等待之后已经超过 deadline 的时候就不再重试
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+			return resp, err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, err
+		}
+		backoff *= 2
+		if policy.MaxBackoff > 0 {
+			backoff = min(backoff, policy.MaxBackoff)
+		}
+	}
+}
+
+// invokeAttempt 发送一次请求。doInvoke 会修改请求，所以每次都使用一个副本
+func (c *Client) invokeAttempt(ctx context.Context, req *message.Request, attempt int) (*message.Response, error) {
+	if c.retryPolicy.PerAttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.retryPolicy.PerAttemptTimeout)
+		defer cancel()
+	}
+	r := *req
+	r.Meta = maps.Clone(req.Meta)
+	if r.Meta == nil {
+		r.Meta = make(map[string]string, 2)
+	}
+	r.Meta["attempt"] = strconv.Itoa(attempt)
+	if deadline, ok := ctx.Deadline(); ok {
+		r.Meta["deadline"] = strconv.FormatInt(deadline.UnixMilli(), 10)
+	}
+	resp, err := c.doInvoke(ctx, &r)
+	if c.retryPolicy.PerAttemptTimeout <= 0 {
+		return resp, err
+	}
+	// 只是这一次尝试超时了，可以重试。服务端按照同一个 deadline 超时，可能先返回超时的错误
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = Retryable(err)
+	} else if err == nil && string(resp.Error) == context.DeadlineExceeded.Error() {
+		resp.Flags |= message.FlagRetryable
+	}
+	return resp, err
+}
+
+// retryable 判断一次尝试的结果能不能重试
+func retryable(resp *message.Response, err error) bool {
+	if err != nil {
+		// 连接被拒绝或者还在建立的时候，请求还没有发出去
+		return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, errs.ErrClientConnecting) ||
+			errors.Is(err, errs.ErrRetryable) || errors.Is(err, errs.ErrServerDraining)
+	}
+	if resp == nil || len(resp.Error) == 0 {
+		return false
+	}
+	// Version3 之前的帧没有标记位，只能比较错误信息
+	return resp.Flags&message.FlagRetryable != 0 || string(resp.Error) == errs.ErrServerDraining.Error()
+}
+
+// jitter 给退避时间加上正负 20% 的随机抖动，避免很多客户端在同一个时间重试
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*0.4-0.2)*float64(d))
+}
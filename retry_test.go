@@ -0,0 +1,218 @@
+package go_rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-rpc/internal/errs"
+	"go-rpc/message"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClient_Retry(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:       3,
+		InitialBackoff:    time.Millisecond * 10,
+		MaxBackoff:        time.Millisecond * 50,
+		PerAttemptTimeout: time.Millisecond * 100,
+		IdempotentMethods: []string{"user-service.GetById"},
+	}
+
+	testCases := []struct {
+		name    string
+		service *UserServiceServerFlaky
+		policy  RetryPolicy
+		ctx     context.Context
+
+		wantErr      string
+		wantAttempts []string
+	}{
+		{
+			name:         "retry until success",
+			service:      &UserServiceServerFlaky{failures: 2, err: Retryable(errors.New("暂时不可用"))},
+			policy:       policy,
+			wantAttempts: []string{"1", "2", "3"},
+		},
+		{
+			name:         "max attempts",
+			service:      &UserServiceServerFlaky{failures: 5, err: Retryable(errors.New("暂时不可用"))},
+			policy:       policy,
+			wantErr:      "暂时不可用",
+			wantAttempts: []string{"1", "2", "3"},
+		},
+		{
+			name:         "not retryable",
+			service:      &UserServiceServerFlaky{failures: 1, err: errors.New("用户不存在")},
+			policy:       policy,
+			wantErr:      "用户不存在",
+			wantAttempts: []string{"1"},
+		},
+		{
+			name:    "not idempotent",
+			service: &UserServiceServerFlaky{failures: 1, err: Retryable(errors.New("暂时不可用"))},
+			policy: RetryPolicy{
+				MaxAttempts:    3,
+				InitialBackoff: time.Millisecond * 10,
+			},
+			wantErr:      "暂时不可用",
+			wantAttempts: []string{""},
+		},
+		{
+			name:    "idempotent call",
+			service: &UserServiceServerFlaky{failures: 1, err: Retryable(errors.New("暂时不可用"))},
+			policy: RetryPolicy{
+				MaxAttempts:    3,
+				InitialBackoff: time.Millisecond * 10,
+			},
+			ctx:          CtxWithCallOptions(context.Background(), CallWithIdempotent()),
+			wantAttempts: []string{"1", "2"},
+		},
+		{
+			// 第一次尝试超时之后重试
+			name:         "per attempt timeout",
+			service:      &UserServiceServerFlaky{failures: 1, sleep: time.Millisecond * 300},
+			policy:       policy,
+			wantAttempts: []string{"1", "2"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer()
+			server.RegisterService(tc.service)
+			addr := startServer(t, server)
+			client, err := NewClient(addr, ClientWithRetryPolicy(tc.policy))
+			require.NoError(t, err)
+			defer client.Close()
+			usClient := &UserService{}
+			require.NoError(t, client.InitService(usClient))
+
+			ctx := tc.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			resp, err := usClient.GetById(ctx, &GetByIdReq{Id: 1})
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, "go-rpc", resp.Msg)
+			}
+			assert.Equal(t, tc.wantAttempts, tc.service.getAttempts())
+		})
+	}
+}
+
+func TestClient_RetryConnRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	client, err := NewClient(addr, ClientWithNonBlocking(),
+		ClientWithDialBackoff(time.Millisecond*10, time.Millisecond*20),
+		ClientWithRetryPolicy(RetryPolicy{
+			MaxAttempts:       20,
+			InitialBackoff:    time.Millisecond * 20,
+			MaxBackoff:        time.Millisecond * 50,
+			IdempotentMethods: []string{"user-service.GetById"},
+		}))
+	require.NoError(t, err)
+	defer client.Close()
+	usClient := &UserService{}
+	require.NoError(t, client.InitService(usClient))
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		server := NewServer()
+		server.RegisterService(&UserServiceServer{Msg: "go-rpc"})
+		l, er := net.Listen("tcp", addr)
+		if er != nil {
+			return
+		}
+		t.Cleanup(func() {
+			_ = server.Close()
+		})
+		_ = server.Serve(l)
+	}()
+
+	resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "go-rpc", resp.Msg)
+}
+
+func TestRetryable(t *testing.T) {
+	testCases := []struct {
+		name string
+		resp *message.Response
+		err  error
+		want bool
+	}{
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, want: true},
+		{name: "connecting", err: errs.ErrClientConnecting, want: true},
+		{name: "retryable error", err: Retryable(context.DeadlineExceeded), want: true},
+		{name: "other error", err: context.Canceled},
+		{name: "success", resp: &message.Response{}},
+		{
+			name: "retryable flag",
+			resp: &message.Response{Flags: message.FlagRetryable, Error: []byte("暂时不可用")},
+			want: true,
+		},
+		{
+			// 老版本的帧没有标记位
+			name: "draining",
+			resp: &message.Response{Version: message.Version2, Error: []byte(errs.ErrServerDraining.Error())},
+			want: true,
+		},
+		{name: "handler error", resp: &message.Response{Error: []byte("用户不存在")}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, retryable(tc.resp, tc.err))
+		})
+	}
+}
+
+// UserServiceServerFlaky 前 failures 次调用失败，记录每次调用的 attempt 元数据。
+// sleep 大于 0 的时候，失败的调用会一直等到 ctx 结束
+type UserServiceServerFlaky struct {
+	failures int
+	err      error
+	sleep    time.Duration
+
+	mutex    sync.Mutex
+	attempts []string
+}
+
+func (u *UserServiceServerFlaky) GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	u.mutex.Lock()
+	u.attempts = append(u.attempts, MetadataFromContext(ctx)["attempt"])
+	fail := len(u.attempts) <= u.failures
+	u.mutex.Unlock()
+	if !fail {
+		return &GetByIdResp{Msg: "go-rpc"}, nil
+	}
+	if u.sleep > 0 {
+		select {
+		case <-time.After(u.sleep):
+		case <-ctx.Done():
+		}
+		return nil, ctx.Err()
+	}
+	return nil, u.err
+}
+
+func (u *UserServiceServerFlaky) Name() string {
+	return "user-service"
+}
+
+func (u *UserServiceServerFlaky) getAttempts() []string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.attempts
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package go_rpc
+
+import (
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if er := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); er != nil {
+		return er
+	}
+	return err
+}
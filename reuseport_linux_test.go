@@ -0,0 +1,51 @@
+//go:build linux
+
+package go_rpc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestServer_ReusePort(t *testing.T) {
+	server := NewServer(ServerWithReusePort(4))
+	server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Start("tcp", "127.0.0.1:0")
+	}()
+	require.Eventually(t, func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return len(server.listeners) == 4
+	}, time.Second, time.Millisecond*10)
+
+	// 所有的 listener 监听同一个地址
+	addr := server.Addr().String()
+	server.mutex.Lock()
+	for listener := range server.listeners {
+		assert.Equal(t, addr, listener.Addr().String())
+	}
+	server.mutex.Unlock()
+
+	for i := 0; i < 20; i++ {
+		usClient := &UserService{}
+		client, err := NewClient(addr)
+		require.NoError(t, err)
+		require.NoError(t, client.InitService(usClient))
+		resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 123})
+		require.NoError(t, err)
+		assert.Equal(t, "hello, world", resp.Msg)
+	}
+
+	require.NoError(t, server.Close())
+	select {
+	case err := <-serveErr:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return")
+	}
+}
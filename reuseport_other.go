@@ -0,0 +1,12 @@
+//go:build !linux
+
+package go_rpc
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("go-rpc: SO_REUSEPORT is only supported on linux")
+}
@@ -2,35 +2,153 @@ package go_rpc
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"go-rpc/compress"
 	"go-rpc/internal/errs"
 	"go-rpc/message"
 	"go-rpc/serialize"
 	"net"
 	"reflect"
+	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type Server struct {
-	services   map[string]reflectionStub
-	serializes map[uint8]serialize.Serializer
+	services    map[string]reflectionStub
+	serializes  map[uint8]serialize.Serializer
+	compressors map[uint8]compress.Compressor
+
+	maxHeaderSize uint32
+	maxBodySize   uint32
+
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+
+	transport    Transport
+	tlsConfig    *tls.Config
+	certReloader *CertReloader
+
+	// eventLoops 是 event loop 的数量，0 表示每个连接使用一个 goroutine
+	eventLoops int
+	loops      *eventLoops
+
+	// reusePort 是用 SO_REUSEPORT 监听同一个地址的 listener 数量
+	reusePort int
+
+	mutex sync.Mutex
+	// listeners 的 key 是正在接收连接的 listener，value 是包装成 TLS 之前的 listener
+	listeners  map[net.Listener]net.Listener
+	conns      map[*serverConn]struct{}
+	inShutdown atomic.Bool
+	// httpActive 是通过 ServeHTTP 正在执行的请求数量
+	httpActive atomic.Int32
+}
+
+type ServerOption func(s *Server)
+
+// ServerWithFrameLimits 限制请求的头部和 body 的大小，超过限制的连接会被直接关闭
+func ServerWithFrameLimits(maxHeaderSize, maxBodySize uint32) ServerOption {
+	return func(s *Server) {
+		s.maxHeaderSize = maxHeaderSize
+		s.maxBodySize = maxBodySize
+	}
+}
+
+// ServerWithHeartbeat 设置心跳。连接空闲超过 interval 就发送 ping，
+// 超过 timeout 没有收到客户端的任何数据就关闭连接。
+// 只有协商出 Version3 的连接才发送 ping，老的客户端在没有请求执行的时候空闲超过 timeout 也会被关闭。
+// interval 为 0 的时候关闭心跳
+func ServerWithHeartbeat(interval, timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.heartbeatInterval = interval
+		s.heartbeatTimeout = timeout
+	}
+}
+
+// ServerWithTransport 设置 Start 创建 listener 的方式。
+// 设置了之后 Start 会忽略 network 参数
+func ServerWithTransport(transport Transport) ServerOption {
+	return func(s *Server) {
+		s.transport = transport
+	}
+}
+
+// ServerWithTLSConfig 让服务端使用 TLS。
+// 需要双向认证的时候设置 config.ClientAuth 为 tls.RequireAndVerifyClientCert，
+// 校验通过的客户端证书可以通过 PeerFromContext 拿到
+func ServerWithTLSConfig(config *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// ServerWithCertReloader 让服务端使用 reloader 加载的证书，证书更新之后不需要重启。
+// ServerWithTLSConfig 设置的配置会作为基础配置
+func ServerWithCertReloader(reloader *CertReloader) ServerOption {
+	return func(s *Server) {
+		s.certReloader = reloader
+	}
+}
+
+// ServerWithEventLoop 让服务端在 Linux 上用 epoll 管理连接。
+// 少数几个 loop 只读取可读的连接，把完整的请求交给单独的 goroutine 处理，
+// 空闲的连接不会占用 goroutine，适合大量空闲连接的场景。
+// TLS 这种不能直接读取 fd 的连接还是每个连接使用一个 goroutine。
+// loops 小于等于 0 的时候使用 CPU 的数量
+func ServerWithEventLoop(loops int) ServerOption {
+	return func(s *Server) {
+		if loops <= 0 {
+			loops = runtime.NumCPU()
+		}
+		s.eventLoops = loops
+	}
+}
+
+// ServerWithReusePort 让 Start 用 SO_REUSEPORT 在同一个 TCP 地址上创建 acceptors 个 listener，
+// 每个 listener 有自己的 accept 循环，内核会把新的连接分散到它们上面。目前只支持 Linux
+func ServerWithReusePort(acceptors int) ServerOption {
+	return func(s *Server) {
+		s.reusePort = acceptors
+	}
 }
 
-func NewServer() *Server {
-	return &Server{
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
 		services: make(map[string]reflectionStub, 16),
 		serializes: map[uint8]serialize.Serializer{
 			1: &serialize.JsonSerializer{},
 			2: &serialize.ProtoSerializer{},
 		},
+		compressors: map[uint8]compress.Compressor{
+			1: &compress.GzipCompressor{},
+		},
+		maxHeaderSize:     DefaultMaxHeaderSize,
+		maxBodySize:       DefaultMaxBodySize,
+		heartbeatInterval: DefaultHeartbeatInterval,
+		heartbeatTimeout:  DefaultHeartbeatTimeout,
+		listeners:         make(map[net.Listener]net.Listener, 1),
+		conns:             make(map[*serverConn]struct{}, 16),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *Server) RegisterSerializer(serializer serialize.Serializer) {
 	s.serializes[serializer.Code()] = serializer
 }
 
+func (s *Server) RegisterCompressor(compressor compress.Compressor) {
+	s.compressors[compressor.Code()] = compressor
+}
+
 func (s *Server) RegisterService(service Service) {
 	s.services[service.Name()] = reflectionStub{
 		s:          service,
@@ -39,88 +157,692 @@ func (s *Server) RegisterService(service Service) {
 	}
 }
 
+// Start 监听 addr 并且开始接收连接。network 是 unix 的时候 addr 是 socket 文件的路径，
+// 在 Linux 上 @ 开头的 addr 表示 abstract namespace。
+// 进程是由 Restart 启动的时候，直接使用从老进程继承的 socket
 func (s *Server) Start(network, addr string) error {
-	listener, err := net.Listen(network, addr)
+	listeners, err := s.listen(network, addr)
 	if err != nil {
 		return err
 	}
+	notifyRestartReady()
+	if len(listeners) == 1 {
+		return s.Serve(listeners[0])
+	}
+	errCh := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errCh <- s.Serve(listener)
+		}(listener)
+	}
+	for range listeners {
+		if er := <-errCh; er != nil && err == nil {
+			err = er
+		}
+	}
+	return err
+}
 
+func (s *Server) listen(network, addr string) ([]net.Listener, error) {
+	if s.transport == nil {
+		if listeners := inheritedListeners(network, addr); len(listeners) > 0 {
+			return listeners, nil
+		}
+	}
+	var (
+		listener net.Listener
+		err      error
+	)
+	switch {
+	case s.transport != nil:
+		listener, err = s.transport.Listen(addr)
+	case network == "unix":
+		listener, err = listenUnix(addr)
+	case s.reusePort > 0:
+		return listenReusePort(network, addr, s.reusePort)
+	default:
+		listener, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{listener}, nil
+}
+
+// Serve 在 listener 上接收连接，直到 listener 被关闭。
+// 调用 Close 或者 Shutdown 之后返回 errs.ErrServerClosed
+func (s *Server) Serve(listener net.Listener) error {
+	return s.accept(listener, s.startEventLoops, s.handleConn)
+}
+
+// accept 接收连接并且交给 handle 处理，start 在 listener 记录下来之后、开始接收之前调用
+func (s *Server) accept(listener net.Listener, start func() error, handle func(conn net.Conn) error) error {
+	raw := listener
+	tlsConfig := s.tlsConfig
+	if s.certReloader != nil {
+		tlsConfig = s.certReloader.ServerConfig(tlsConfig)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	if !s.trackListener(listener, raw) {
+		_ = listener.Close()
+		return errs.ErrServerClosed
+	}
+	defer s.untrackListener(listener)
+	if start != nil {
+		if err := start(); err != nil {
+			return err
+		}
+	}
+
+	var backoff acceptBackoff
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.inShutdown.Load() {
+				return errs.ErrServerClosed
+			}
+			if isTemporaryAcceptErr(err) {
+				backoff.wait()
+				continue
+			}
 			return err
 		}
+		backoff.reset()
 		go func() {
-			if er := s.handleConn(conn); er != nil {
+			if er := handle(conn); er != nil {
 				_ = conn.Close()
 			}
 		}()
 	}
 }
 
-func (s *Server) handleConn(conn net.Conn) error {
+const (
+	minAcceptDelay = time.Millisecond * 5
+	maxAcceptDelay = time.Second
+)
+
+// acceptBackoff 是 Accept 连续遇到暂时的错误时的等待时间，从 minAcceptDelay 开始翻倍，不超过 maxAcceptDelay
+type acceptBackoff struct {
+	delay time.Duration
+}
+
+func (b *acceptBackoff) wait() {
+	b.delay = min(max(b.delay*2, minAcceptDelay), maxAcceptDelay)
+	time.Sleep(b.delay)
+}
+
+func (b *acceptBackoff) reset() {
+	b.delay = 0
+}
+
+// isTemporaryAcceptErr 判断 Accept 的错误是不是暂时的，比如文件描述符用完了。
+// 这时候等一会儿再接收连接，而不是让整个服务退出
+func isTemporaryAcceptErr(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+// startEventLoops 在第一次 Serve 的时候启动 event loop，之后的 Serve 共用它们
+func (s *Server) startEventLoops() error {
+	if s.eventLoops == 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.loops != nil {
+		return nil
+	}
+	loops, err := newEventLoops(s.eventLoops)
+	if err != nil {
+		return err
+	}
+	s.loops = loops
+	return nil
+}
+
+// Addr 返回正在监听的地址，还没有开始监听的时候返回 nil
+func (s *Server) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for listener := range s.listeners {
+		return listener.Addr()
+	}
+	return nil
+}
+
+// Close 立刻关闭所有的 listener 和连接，正在执行的请求会被取消
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.closeListeners()
+	for sc := range s.conns {
+		_ = sc.conn.Close()
+		delete(s.conns, sc)
+	}
+	s.closeEventLoops()
+	return err
+}
+
+// Shutdown 优雅退出。它先关闭所有的 listener，然后通知客户端不要再往连接上发送新的请求，
+// 等待正在执行的请求结束之后再关闭连接。
+// ctx 过期的时候直接关闭剩下的连接，并且返回 ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+	s.mutex.Lock()
+	err := s.closeListeners()
+	for sc := range s.conns {
+		sc.drain()
+	}
+	s.mutex.Unlock()
+
+	ticker := time.NewTicker(time.Millisecond * 10)
+	defer ticker.Stop()
 	for {
-		reqBs, err := ReadMsg(conn)
-		if err != nil {
+		if s.closeIdleConns() {
 			return err
 		}
-
-		req := message.DecodeReq(reqBs)
-		if err != nil {
-			return err
+		select {
+		case <-ctx.Done():
+			_ = s.Close()
+			return ctx.Err()
+		case <-ticker.C:
 		}
+	}
+}
 
-		ctx := context.Background()
+func (s *Server) trackListener(listener, raw net.Listener) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.inShutdown.Load() {
+		return false
+	}
+	s.listeners[listener] = raw
+	return true
+}
 
-		var cancel context.CancelFunc
-		if deadlineStr, ok := req.Meta["deadline"]; ok {
-			if deadline, er := strconv.ParseInt(deadlineStr, 10, 64); er == nil {
-				ctx, cancel = context.WithDeadline(ctx, time.UnixMilli(deadline))
-			}
+func (s *Server) untrackListener(listener net.Listener) {
+	s.mutex.Lock()
+	delete(s.listeners, listener)
+	s.mutex.Unlock()
+}
 
+func (s *Server) closeListeners() error {
+	var err error
+	for listener := range s.listeners {
+		if er := listener.Close(); er != nil && err == nil {
+			err = er
 		}
+		delete(s.listeners, listener)
+	}
+	return err
+}
 
-		oneway, ok := req.Meta["one-way"]
-		if ok && oneway == "true" {
-			go func() {
-				_, _ = s.Invoke(CtxWithOneway(ctx), req)
-			}()
-			cancel()
-			return errs.ErrIsOneway
-		}
+func (s *Server) trackConn(sc *serverConn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.inShutdown.Load() {
+		return false
+	}
+	s.conns[sc] = struct{}{}
+	return true
+}
 
-		resp, err := s.Invoke(ctx, req)
-		cancel()
-		if err != nil {
-			resp.Error = []byte(err.Error())
+func (s *Server) untrackConn(sc *serverConn) {
+	s.mutex.Lock()
+	delete(s.conns, sc)
+	s.mutex.Unlock()
+}
+
+// closeIdleConns 关闭没有正在执行的请求的连接，返回是否所有的连接都已经关闭
+func (s *Server) closeIdleConns() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for sc := range s.conns {
+		if sc.active.Load() == 0 {
+			_ = sc.conn.Close()
+			delete(s.conns, sc)
 		}
-		resp.CalculateHeaderLength()
-		resp.CalculateBodyLength()
+	}
+	if len(s.conns) > 0 || s.httpActive.Load() > 0 {
+		return false
+	}
+	s.closeEventLoops()
+	return true
+}
+
+// closeEventLoops 在所有连接都关闭之后停止 event loop，调用者需要持有 mutex。
+// Shutdown 之后还可能调用 Close，所以停止之后把 loops 清空
+func (s *Server) closeEventLoops() {
+	if s.loops != nil {
+		s.loops.close()
+		s.loops = nil
+	}
+}
 
-		_, err = conn.Write(resp.Encode())
+// handleConn 持续读取请求，每个请求都在单独的 goroutine 里面处理，
+// 所以慢的请求不会阻塞同一个连接上的其它请求。
+// 开启了 event loop 的时候，能够直接读取 fd 的连接交给 event loop，不再占用 goroutine
+func (s *Server) handleConn(conn net.Conn) error {
+	peer, err := newPeer(conn)
+	if err != nil {
+		return err
+	}
+	var lc *loopConn
+	s.mutex.Lock()
+	loops := s.loops
+	s.mutex.Unlock()
+	if loops != nil {
+		if lc = loops.wrap(conn); lc != nil {
+			conn = lc
+		}
+	}
+	sc := newServerConn(conn, peer)
+	sc.startKeepalive(s.heartbeatInterval, s.heartbeatTimeout)
+	if lc != nil {
+		sc.async = true
+		// 连接关闭的时候由 loopConn 释放资源
+		if err = lc.start(s, sc); err != nil {
+			sc.stopKeepalive()
+		}
+		return err
+	}
+	if !s.trackConn(sc) {
+		sc.stopKeepalive()
+		return errs.ErrServerClosed
+	}
+	defer s.releaseConn(sc)
+	fr := NewFrameReader(conn, s.maxHeaderSize, s.maxBodySize)
+	for {
+		reqBs, err := fr.ReadFrame()
 		if err != nil {
 			return err
 		}
+		if err = s.handleFrame(sc, reqBs); err != nil {
+			return err
+		}
+	}
+}
+
+// releaseConn 在连接断开之后释放连接的资源，并且取消所有还在执行的请求
+func (s *Server) releaseConn(sc *serverConn) {
+	s.untrackConn(sc)
+	sc.cancel()
+	sc.stopKeepalive()
+}
+
+// handleFrame 处理读到的一个帧，返回错误的时候需要关闭连接
+func (s *Server) handleFrame(sc *serverConn, reqBs []byte) error {
+	if sc.keepalive != nil {
+		sc.keepalive.touch()
+	}
+
+	req, err := message.DecodeReq(reqBs)
+	if err != nil {
+		// 帧的边界还是完整的，所以告诉客户端这个请求有问题，然后继续处理后面的请求
+		return sc.writeProtocolError(reqBs, err)
+	}
+	switch req.Kind {
+	case 0, message.KindRequest:
+		if req.ServiceName == message.HandshakeService && req.MethodName == message.HandshakeMethod {
+			return s.handshake(sc, req)
+		}
+		sc.active.Add(1)
+		if sc.draining.Load() {
+			sc.active.Add(-1)
+			return sc.reject(req, errs.ErrServerDraining)
+		}
+		// 在读取下一个帧之前登记请求，紧跟在请求后面的取消帧才能找到它
+		ctx, done := sc.startRequest(req)
+		go s.serve(ctx, sc, req, done)
+	case message.KindPing:
+		return sc.write(encodeControl(true, message.KindPong, 0))
+	case message.KindCancel:
+		sc.cancelRequest(req.RequestId)
+	default:
+		// pong 只需要更新读到数据的时间；
+		// 不认识的控制帧直接忽略，方便以后增加新的帧类型
+	}
+	return nil
+}
+
+func (s *Server) serve(ctx context.Context, sc *serverConn, req *message.Request, done func()) {
+	defer sc.active.Add(-1)
+	defer done()
+
+	ctx, cancel := withDeadline(ctx, req)
+	defer cancel()
+
+	if isOnewayReq(req) {
+		_, _ = s.Invoke(CtxWithOneway(ctx), req)
+		return
+	}
+
+	resp, err := s.Invoke(ctx, req)
+	// 客户端已经不要这个响应了
+	if errors.Is(context.Cause(ctx), errs.ErrCanceledByClient) {
+		return
+	}
+	if err != nil {
+		setResponseError(resp, err)
+	}
+	if er := sc.fw.WriteFrame(encodeResponse(resp)); er != nil {
+		_ = sc.conn.Close()
+	}
+}
+
+// withDeadline 使用客户端在元数据里面传过来的超时时间
+func withDeadline(ctx context.Context, req *message.Request) (context.Context, context.CancelFunc) {
+	if deadlineStr, ok := req.Meta["deadline"]; ok {
+		if deadline, err := strconv.ParseInt(deadlineStr, 10, 64); err == nil {
+			return context.WithDeadline(ctx, time.UnixMilli(deadline))
+		}
 	}
+	return ctx, func() {}
+}
+
+func encodeResponse(resp *message.Response) []byte {
+	resp.CalculateHeaderLength()
+	resp.CalculateBodyLength()
+	return resp.Encode()
 }
 
 func (s *Server) Invoke(ctx context.Context, req *message.Request) (*message.Response, error) {
+	resp := &message.Response{
+		Kind:       message.KindResponse,
+		RequestId:  req.RequestId,
+		Version:    req.Version,
+		Compresser: req.Compresser,
+		Serializer: req.Serializer,
+	}
 	service, ok := s.services[req.ServiceName]
 	if !ok {
-		return nil, errors.New("你要调用的服务不存在")
+		return resp, errs.ErrServiceNotFound
+	}
+	var compressor compress.Compressor
+	if req.Compresser != 0 {
+		compressor, ok = s.compressors[req.Compresser]
+		if !ok {
+			resp.Compresser = 0
+			return resp, fmt.Errorf("%w: %d", errs.ErrCompressorNotSupported, req.Compresser)
+		}
+		data, err := compressor.Decompress(req.Data, s.maxBodySize)
+		if err != nil {
+			return resp, fmt.Errorf("%w: %w", errs.ErrInvalidArgument, err)
+		}
+		decompressed := *req
+		decompressed.Data = data
+		req = &decompressed
 	}
 
-	respData, err := service.invoke(ctx, req)
+	respData, err := service.invoke(ctxWithMetadata(ctx, req.Meta), req)
+	// 响应使用和请求一样的压缩算法
+	if compressor != nil && len(respData) > 0 {
+		compressed, er := compressor.Compress(respData)
+		if er != nil {
+			return resp, er
+		}
+		respData = compressed
+		if resp.Version >= message.Version3 {
+			resp.Flags |= message.FlagCompressed
+		}
+	}
+	resp.Data = respData
+	return resp, err
+}
+
+// isOnewayReq 判断请求是不是 oneway 的。
+// Version3 只看标记位，之前的版本用元数据
+func isOnewayReq(req *message.Request) bool {
+	if req.Version >= message.Version3 {
+		return req.Flags&message.FlagOneway != 0
+	}
+	return req.Meta["one-way"] == "true"
+}
+
+// serverConn 是服务端的连接，多个 goroutine 会并发写响应
+type serverConn struct {
+	conn net.Conn
+	fw   *FrameWriter
+
+	// ctx 在连接断开的时候被取消，所有请求的 context 都从它派生。
+	// 它还带着调用方的信息
+	ctx    context.Context
+	cancel context.CancelFunc
 
-	return &message.Response{
+	mutex sync.Mutex
+	// inflight 保存正在执行的请求，客户端可以通过 cancel 帧取消它们
+	inflight map[uint32]context.CancelCauseFunc
+	// active 是正在执行的请求数量，Shutdown 等它变成 0 之后再关闭连接
+	active atomic.Int32
+	// draining 表示服务端正在退出，不再接收新的请求
+	draining atomic.Bool
+
+	// version 是握手协商出来的版本，没有握手的老客户端是 0。
+	// version 和 keepalive 只在读取请求的 goroutine 里面修改，
+	// 其它 goroutine 读取它们的时候需要持有 mutex
+	version   uint8
+	keepalive *keepalive
+
+	// async 表示连接由 event loop 读取。loop 里面不能阻塞，
+	// 所以读取请求的时候要回复的帧放在 queue 里面，由单独的 goroutine 发送，queue 由 mutex 保护
+	async   bool
+	queue   [][]byte
+	writing bool
+}
+
+// maxQueuedFrames 是 event loop 的连接上最多排队等待发送的帧数，
+// 超过的时候说明对端一直不读数据，直接关闭连接
+const maxQueuedFrames = 64
+
+func newServerConn(conn net.Conn, peer *Peer) *serverConn {
+	ctx, cancel := context.WithCancel(CtxWithPeer(context.Background(), peer))
+	return &serverConn{
+		conn:   conn,
+		fw:     NewFrameWriter(conn),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// startRequest 创建处理请求的 context 并且登记请求，请求处理完之后调用返回的函数
+func (sc *serverConn) startRequest(req *message.Request) (context.Context, func()) {
+	// oneway 请求的客户端不关心结果，所以连接断开也不取消它
+	if isOnewayReq(req) {
+		return context.WithoutCancel(sc.ctx), func() {}
+	}
+	ctx, cancel := context.WithCancelCause(sc.ctx)
+	sc.addRequest(req, cancel)
+	return ctx, func() {
+		sc.removeRequest(req)
+		cancel(nil)
+	}
+}
+
+// addRequest 记录正在执行的请求。
+// 只有 Version3 的请求 ID 保证在连接上唯一，老客户端发不出 cancel 帧，所以不需要记录
+func (sc *serverConn) addRequest(req *message.Request, cancel context.CancelCauseFunc) {
+	if req.Version < message.Version3 {
+		return
+	}
+	sc.mutex.Lock()
+	// 大部分连接都是空闲的，第一次有请求的时候再创建
+	if sc.inflight == nil {
+		sc.inflight = make(map[uint32]context.CancelCauseFunc)
+	}
+	sc.inflight[req.RequestId] = cancel
+	sc.mutex.Unlock()
+}
+
+func (sc *serverConn) removeRequest(req *message.Request) {
+	if req.Version < message.Version3 {
+		return
+	}
+	sc.mutex.Lock()
+	delete(sc.inflight, req.RequestId)
+	sc.mutex.Unlock()
+}
+
+func (sc *serverConn) cancelRequest(id uint32) {
+	sc.mutex.Lock()
+	cancel, ok := sc.inflight[id]
+	sc.mutex.Unlock()
+	if ok {
+		cancel(errs.ErrCanceledByClient)
+	}
+}
+
+// write 在读取请求的时候回复一个帧，例如握手的响应和 pong。
+// 普通的连接直接写；event loop 的连接不能阻塞 loop，交给单独的 goroutine 按顺序发送
+func (sc *serverConn) write(data []byte) error {
+	if !sc.async {
+		return sc.fw.WriteFrame(data)
+	}
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if len(sc.queue) >= maxQueuedFrames {
+		return errs.ErrWriteQueueFull
+	}
+	sc.queue = append(sc.queue, data)
+	if !sc.writing {
+		sc.writing = true
+		go sc.flushQueue()
+	}
+	return nil
+}
+
+func (sc *serverConn) flushQueue() {
+	for {
+		sc.mutex.Lock()
+		if len(sc.queue) == 0 {
+			sc.writing = false
+			sc.queue = nil
+			sc.mutex.Unlock()
+			return
+		}
+		data := sc.queue[0]
+		sc.queue = sc.queue[1:]
+		sc.mutex.Unlock()
+		if err := sc.fw.WriteFrame(data); err != nil {
+			_ = sc.conn.Close()
+			return
+		}
+	}
+}
+
+// drain 通知客户端不要再往这个连接上发送新的请求。
+// 只有 Version3 的客户端认识 goaway 帧；写可能会被阻塞，所以不等待它完成
+func (sc *serverConn) drain() {
+	sc.draining.Store(true)
+	sc.mutex.Lock()
+	version := sc.version
+	sc.mutex.Unlock()
+	if version < message.Version3 {
+		return
+	}
+	go func() {
+		_ = sc.fw.WriteFrame(encodeControl(true, message.KindGoAway, 0))
+	}()
+}
+
+// reject 直接用 err 回复请求，不执行它
+func (sc *serverConn) reject(req *message.Request, err error) error {
+	if isOnewayReq(req) {
+		return nil
+	}
+	return sc.write(encodeResponse(rejectResponse(req, err)))
+}
+
+func rejectResponse(req *message.Request, err error) *message.Response {
+	resp := &message.Response{
+		Kind:       message.KindResponse,
 		RequestId:  req.RequestId,
 		Version:    req.Version,
-		Compresser: req.Compresser,
 		Serializer: req.Serializer,
-		Data:       respData,
-	}, err
+	}
+	setResponseError(resp, err)
+	return resp
+}
+
+// setResponseError 把 err 写到响应里面，可以重试的错误加上 FlagRetryable
+func setResponseError(resp *message.Response, err error) {
+	resp.Error = []byte(err.Error())
+	if errors.Is(err, errs.ErrRetryable) || errors.Is(err, errs.ErrServerDraining) {
+		resp.Flags |= message.FlagRetryable
+	}
+}
+
+// startKeepalive 在连接建立之后开始检测空闲。
+// 握手协商出 Version3 的连接会发送心跳；老的客户端不认识 ping，
+// 只能在没有请求执行、也没有读到数据超过 timeout 的时候关闭连接
+func (sc *serverConn) startKeepalive(interval, timeout time.Duration) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if interval <= 0 || sc.keepalive != nil || sc.ctx.Err() != nil {
+		return
+	}
+	sc.keepalive = newKeepalive(interval, timeout, func() error {
+		sc.mutex.Lock()
+		version, k := sc.version, sc.keepalive
+		sc.mutex.Unlock()
+		if version >= message.Version3 {
+			return sc.fw.WriteFrame(encodeControl(true, message.KindPing, 0))
+		}
+		// 客户端还在等待响应，连接不算空闲
+		if sc.active.Load() > 0 {
+			k.touch()
+		}
+		return nil
+	}, func(err error) {
+		_ = sc.conn.Close()
+	})
+}
+
+func (sc *serverConn) stopKeepalive() {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if sc.keepalive != nil {
+		sc.keepalive.stop()
+	}
+}
+
+// writeProtocolError 回复一个无法解析的请求。
+// FrameReader 保证了 data 至少包含头部的固定部分，所以请求 ID 和版本号都是可以读出来的。
+// 客户端的版本不被支持的时候，用 Version1 回复，并且在 body 里面带上支持的版本范围
+func (sc *serverConn) writeProtocolError(data []byte, err error) error {
+	return sc.write(encodeResponse(protocolErrorResponse(data, err)))
+}
+
+func protocolErrorResponse(data []byte, err error) *message.Response {
+	requestId, version := message.PeekHeader(data)
+	resp := &message.Response{
+		Kind:      message.KindResponse,
+		RequestId: requestId,
+		Version:   version,
+		Error:     []byte(err.Error()),
+	}
+	var verErr *message.UnsupportedVersionError
+	if errors.As(err, &verErr) || version > message.MaxSupportedVersion {
+		resp.Version = message.Version1
+		resp.Data = (&message.Handshake{
+			MinVersion: message.MinSupportedVersion,
+			MaxVersion: message.MaxSupportedVersion,
+		}).Encode()
+	}
+	return resp
 }
 
+var (
+	contextType = reflect.TypeOf(new(context.Context)).Elem()
+	errorType   = reflect.TypeOf(new(error)).Elem()
+)
+
 type reflectionStub struct {
 	s          Service
 	value      reflect.Value
@@ -129,6 +851,11 @@ type reflectionStub struct {
 
 func (s *reflectionStub) invoke(ctx context.Context, req *message.Request) ([]byte, error) {
 	method := s.value.MethodByName(req.MethodName)
+	// 方法名是客户端传过来的，可能不存在或者不是 RPC 方法，
+	// 只有 func(context.Context, *Req) (Resp, error) 这样的方法才能调用
+	if !method.IsValid() || !isRPCMethod(method.Type()) {
+		return nil, fmt.Errorf("%w: %s", errs.ErrMethodNotFound, req.MethodName)
+	}
 	in := make([]reflect.Value, 2)
 	in[0] = reflect.ValueOf(ctx)
 	inReq := reflect.New(method.Type().In(1).Elem())
@@ -140,7 +867,7 @@ func (s *reflectionStub) invoke(ctx context.Context, req *message.Request) ([]by
 
 	err := serializer.Decode(req.Data, inReq.Interface())
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", errs.ErrInvalidArgument, err)
 	}
 	in[1] = inReq
 	results := method.Call(in)
@@ -156,3 +883,8 @@ func (s *reflectionStub) invoke(ctx context.Context, req *message.Request) ([]by
 
 	return resp, nil
 }
+
+func isRPCMethod(typ reflect.Type) bool {
+	return typ.NumIn() == 2 && typ.NumOut() == 2 &&
+		typ.In(0) == contextType && typ.In(1).Kind() == reflect.Pointer && typ.Out(1) == errorType
+}
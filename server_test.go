@@ -0,0 +1,118 @@
+package go_rpc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-rpc/message"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_CancelByClient(t *testing.T) {
+	server := NewServer()
+	service := &UserServiceServerBlocking{done: make(chan error, 1)}
+	server.RegisterService(service)
+	cConn, sConn := net.Pipe()
+	go func() {
+		_ = server.handleConn(sConn)
+	}()
+	cc := newClientConn(cConn, NewFrameReader(cConn, DefaultMaxHeaderSize, DefaultMaxBodySize))
+	defer cc.close(nil)
+	require.NoError(t, cc.handshake(context.Background(), 1, []uint8{1}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+	}()
+	_, err := cc.send(ctx, newGetByIdReq(2, cc.version))
+	assert.Equal(t, context.Canceled, err)
+
+	select {
+	case err = <-service.done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("handler not canceled")
+	}
+}
+
+func TestServer_CancelRightAfterRequest(t *testing.T) {
+	server := NewServer()
+	service := &UserServiceServerBlocking{done: make(chan error, 1)}
+	server.RegisterService(service)
+	cConn, sConn := net.Pipe()
+	go func() {
+		_ = server.handleConn(sConn)
+	}()
+	cc := newClientConn(cConn, NewFrameReader(cConn, DefaultMaxHeaderSize, DefaultMaxBodySize))
+	defer cc.close(nil)
+	require.NoError(t, cc.handshake(context.Background(), 1, []uint8{1}))
+
+	// 取消帧紧跟在请求后面，服务端读到它的时候处理请求的 goroutine 可能还没有开始执行
+	require.NoError(t, cc.fw.WriteFrame(newGetByIdReq(2, cc.version).Encode()))
+	require.NoError(t, cc.fw.WriteFrame(encodeControl(false, message.KindCancel, 2)))
+
+	select {
+	case err := <-service.done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("handler not canceled")
+	}
+}
+
+func TestServer_CancelOnConnClosed(t *testing.T) {
+	server := NewServer()
+	service := &UserServiceServerBlocking{done: make(chan error, 1)}
+	server.RegisterService(service)
+	cConn, sConn := net.Pipe()
+	go func() {
+		_ = server.handleConn(sConn)
+	}()
+	cc := newClientConn(cConn, NewFrameReader(cConn, DefaultMaxHeaderSize, DefaultMaxBodySize))
+	// 老客户端，没有握手也发不出 cancel 帧
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cc.close(nil)
+	}()
+	_, err := cc.send(context.Background(), newGetByIdReq(1, message.Version1))
+	assert.Error(t, err)
+
+	select {
+	case err = <-service.done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("handler not canceled")
+	}
+}
+
+func newGetByIdReq(id uint32, version uint8) *message.Request {
+	req := &message.Request{
+		Kind:        message.KindRequest,
+		RequestId:   id,
+		Version:     version,
+		Serializer:  1,
+		ServiceName: "user-service",
+		MethodName:  "GetById",
+		Data:        []byte(`{"Id":123}`),
+	}
+	req.CalculateHeaderLength()
+	req.CalculateBodyLength()
+	return req
+}
+
+// UserServiceServerBlocking 一直阻塞到 context 被取消
+type UserServiceServerBlocking struct {
+	done chan error
+}
+
+func (u *UserServiceServerBlocking) GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	<-ctx.Done()
+	u.done <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func (u *UserServiceServerBlocking) Name() string {
+	return "user-service"
+}
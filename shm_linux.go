@@ -0,0 +1,444 @@
+//go:build linux
+
+package go_rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// 共享内存的布局：第一页是控制区，每个方向的 ring 占用其中的 shmRingCtrlSize 字节，
+// 控制区后面依次是客户端到服务端的 ring 和服务端到客户端的 ring
+const (
+	shmCtrlSize     = 4096
+	shmRingCtrlSize = 256
+	// head 和 tail 分别只由读的一方和写的一方修改，放在不同的 cache line 上
+	shmHeadOffset          = 0
+	shmTailOffset          = 64
+	shmReaderWaitingOffset = 128
+	shmWriterWaitingOffset = 192
+
+	// shmNegotiateTimeout 限制服务端把共享内存发给客户端的时间
+	shmNegotiateTimeout = time.Second * 5
+)
+
+// shmMagic 是协商消息的开头，后面跟着 4 个字节的 ring 大小
+var shmMagic = [4]byte{'g', 's', 'h', 'm'}
+
+// ShmTransport 通过共享内存在同一台机器上的进程之间传输数据。
+// addr 是一个 Unix domain socket，只用来协商：服务端创建 memfd 和 eventfd，
+// 通过 SCM_RIGHTS 发给客户端，之后的数据都通过 memfd 上的两个 ring buffer 传输，
+// 只有在对方等待的时候才用 eventfd 唤醒它。
+// Unix domain socket 会一直保持连接，用来发现对方退出
+type ShmTransport struct {
+	// RingSize 是每个方向的 ring buffer 的大小，必须是 2 的幂并且不小于 4096，
+	// 默认是 DefaultShmRingSize。只有服务端的设置会生效
+	RingSize int
+}
+
+func (t *ShmTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialShm(ctx, conn.(*net.UnixConn))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t *ShmTransport) Listen(addr string) (net.Listener, error) {
+	size := t.RingSize
+	if size == 0 {
+		size = DefaultShmRingSize
+	}
+	if !validRingSize(size) {
+		return nil, fmt.Errorf("go-rpc: invalid shm ring size %d", size)
+	}
+	l, err := listenUnix(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &shmListener{UnixListener: l.(*net.UnixListener), ringSize: size}, nil
+}
+
+func validRingSize(size int) bool {
+	return size >= shmCtrlSize && size <= 1<<30 && size&(size-1) == 0
+}
+
+type shmListener struct {
+	*net.UnixListener
+	ringSize int
+}
+
+func (l *shmListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		c, err := acceptShm(conn, l.ringSize)
+		if err != nil {
+			_ = conn.Close()
+			// 本地的文件描述符或者内存不够的时候返回错误，Server 会等一会再接收连接。
+			// 其它的错误只影响这一个连接，继续接收别的连接
+			if isShmResourceErr(err) {
+				return nil, err
+			}
+			continue
+		}
+		return c, nil
+	}
+}
+
+// isShmResourceErr 判断是不是创建 memfd、eventfd 或者映射内存的时候资源不够
+func isShmResourceErr(err error) bool {
+	return errors.Is(err, unix.EMFILE) || errors.Is(err, unix.ENFILE) || errors.Is(err, unix.ENOMEM)
+}
+
+// acceptShm 创建共享内存和 eventfd，并且发给客户端
+func acceptShm(conn *net.UnixConn, size int) (c *shmConn, err error) {
+	memfd, err := unix.MemfdCreate("go-rpc-shm", unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(memfd)
+	length := shmCtrlSize + 2*size
+	if err = unix.Ftruncate(memfd, int64(length)); err != nil {
+		return nil, err
+	}
+	efds := make([]int, 0, 4)
+	defer func() {
+		if err != nil {
+			for _, fd := range efds {
+				_ = unix.Close(fd)
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		fd, er := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+		if er != nil {
+			return nil, er
+		}
+		efds = append(efds, fd)
+	}
+	mem, err := unix.Mmap(memfd, 0, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, 8)
+	copy(payload, shmMagic[:])
+	binary.LittleEndian.PutUint32(payload[4:], uint32(size))
+	_ = conn.SetWriteDeadline(time.Now().Add(shmNegotiateTimeout))
+	_, _, err = conn.WriteMsgUnix(payload, unix.UnixRights(append([]int{memfd}, efds...)...), nil)
+	_ = conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		_ = unix.Munmap(mem)
+		return nil, err
+	}
+	return newShmConn(conn, mem, size, efds, true), nil
+}
+
+// dialShm 从服务端接收共享内存和 eventfd
+func dialShm(ctx context.Context, conn *net.UnixConn) (*shmConn, error) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+	payload := make([]byte, 8)
+	oob := make([]byte, unix.CmsgSpace(5*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(payload, oob)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	var fds []int
+	cmsgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	for _, cmsg := range cmsgs {
+		rights, er := unix.ParseUnixRights(&cmsg)
+		if er != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	// 无论成功还是失败，memfd 在 mmap 之后都不再需要
+	closeFds := fds
+	defer func() {
+		for _, fd := range closeFds {
+			_ = unix.Close(fd)
+		}
+	}()
+
+	if n != len(payload) || [4]byte(payload[:4]) != shmMagic || len(fds) != 5 {
+		return nil, errors.New("go-rpc: invalid shm negotiation")
+	}
+	size := int(binary.LittleEndian.Uint32(payload[4:]))
+	length := shmCtrlSize + 2*size
+	var stat unix.Stat_t
+	if err = unix.Fstat(fds[0], &stat); err != nil {
+		return nil, err
+	}
+	// 文件比映射的长度短的时候访问会触发 SIGBUS
+	if !validRingSize(size) || stat.Size < int64(length) {
+		return nil, errors.New("go-rpc: invalid shm negotiation")
+	}
+	mem, err := unix.Mmap(fds[0], 0, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	closeFds = fds[:1]
+	return newShmConn(conn, mem, size, fds[1:], false), nil
+}
+
+// shmRing 是一个单生产者单消费者的 ring buffer
+type shmRing struct {
+	head          *uint64
+	tail          *uint64
+	readerWaiting *uint32
+	writerWaiting *uint32
+	data          []byte
+	size          uint64
+	// dataEvent 用来唤醒等待数据的一方，spaceEvent 用来唤醒等待空间的一方
+	dataEvent  *os.File
+	spaceEvent *os.File
+}
+
+func newShmRing(ctrl, data []byte, dataEvent, spaceEvent *os.File) *shmRing {
+	return &shmRing{
+		head:          (*uint64)(unsafe.Pointer(&ctrl[shmHeadOffset])),
+		tail:          (*uint64)(unsafe.Pointer(&ctrl[shmTailOffset])),
+		readerWaiting: (*uint32)(unsafe.Pointer(&ctrl[shmReaderWaitingOffset])),
+		writerWaiting: (*uint32)(unsafe.Pointer(&ctrl[shmWriterWaitingOffset])),
+		data:          data,
+		size:          uint64(len(data)),
+		dataEvent:     dataEvent,
+		spaceEvent:    spaceEvent,
+	}
+}
+
+// write 把 p 写到 tail 的位置，最多写 free 个字节
+func (r *shmRing) write(p []byte, tail, free uint64) int {
+	n := min(uint64(len(p)), free)
+	off := tail & (r.size - 1)
+	k := copy(r.data[off:], p[:n])
+	copy(r.data, p[k:n])
+	return int(n)
+}
+
+// read 从 head 的位置读数据到 p，最多读 avail 个字节
+func (r *shmRing) read(p []byte, head, avail uint64) int {
+	n := min(uint64(len(p)), avail)
+	off := head & (r.size - 1)
+	k := copy(p[:n], r.data[off:])
+	copy(p[k:n], r.data)
+	return int(n)
+}
+
+// wake 在对方等待的时候才通过 eventfd 唤醒它，大部分时候不需要系统调用
+func wake(waiting *uint32, event *os.File) {
+	if atomic.CompareAndSwapUint32(waiting, 1, 0) {
+		signal(event)
+	}
+}
+
+func signal(event *os.File) {
+	var buf [8]byte
+	binary.NativeEndian.PutUint64(buf[:], 1)
+	_, _ = event.Write(buf[:])
+}
+
+// shmConn 是基于共享内存的 net.Conn。
+// deadline 只在等待数据或者等待空间的时候生效
+type shmConn struct {
+	conn *net.UnixConn
+	mem  []byte
+	in   *shmRing
+	out  *shmRing
+
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+	closed     atomic.Bool
+	// peerGone 表示对方已经关闭了连接或者进程已经退出
+	peerGone  atomic.Bool
+	closeOnce sync.Once
+}
+
+func newShmConn(conn *net.UnixConn, mem []byte, size int, efds []int, server bool) *shmConn {
+	files := make([]*os.File, 0, len(efds))
+	for _, fd := range efds {
+		files = append(files, os.NewFile(uintptr(fd), "eventfd"))
+	}
+	c2s := newShmRing(mem[:shmRingCtrlSize], mem[shmCtrlSize:shmCtrlSize+size], files[0], files[1])
+	s2c := newShmRing(mem[shmRingCtrlSize:2*shmRingCtrlSize], mem[shmCtrlSize+size:], files[2], files[3])
+	c := &shmConn{conn: conn, mem: mem, in: s2c, out: c2s}
+	if server {
+		c.in, c.out = c2s, s2c
+	}
+	go c.watchPeer()
+	return c
+}
+
+// watchPeer 等待 Unix domain socket 断开，然后唤醒正在等待的读写
+func (c *shmConn) watchPeer() {
+	var buf [1]byte
+	for {
+		if _, err := c.conn.Read(buf[:]); err != nil {
+			break
+		}
+	}
+	c.peerGone.Store(true)
+	// 连接已经关闭的时候文件也已经关闭了，写入会失败，不会访问共享内存
+	signal(c.in.dataEvent)
+	signal(c.out.spaceEvent)
+}
+
+func (c *shmConn) Read(p []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	r := c.in
+	head := atomic.LoadUint64(r.head)
+	for {
+		tail := atomic.LoadUint64(r.tail)
+		if tail != head {
+			n := r.read(p, head, tail-head)
+			atomic.StoreUint64(r.head, head+uint64(n))
+			wake(r.writerWaiting, r.spaceEvent)
+			return n, nil
+		}
+		if c.peerGone.Load() {
+			// 对方关闭之前写的数据要先读完
+			if atomic.LoadUint64(r.tail) != head {
+				continue
+			}
+			return 0, io.EOF
+		}
+		atomic.StoreUint32(r.readerWaiting, 1)
+		if atomic.LoadUint64(r.tail) != head || c.peerGone.Load() {
+			atomic.StoreUint32(r.readerWaiting, 0)
+			continue
+		}
+		if err := c.wait(r.dataEvent); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *shmConn) Write(p []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	r := c.out
+	tail := atomic.LoadUint64(r.tail)
+	written := 0
+	for written < len(p) {
+		if c.peerGone.Load() {
+			return written, io.ErrClosedPipe
+		}
+		head := atomic.LoadUint64(r.head)
+		if free := r.size - (tail - head); free > 0 {
+			n := r.write(p[written:], tail, free)
+			tail += uint64(n)
+			written += n
+			atomic.StoreUint64(r.tail, tail)
+			wake(r.readerWaiting, r.dataEvent)
+			continue
+		}
+		atomic.StoreUint32(r.writerWaiting, 1)
+		if atomic.LoadUint64(r.head) != head || c.peerGone.Load() {
+			atomic.StoreUint32(r.writerWaiting, 0)
+			continue
+		}
+		if err := c.wait(r.spaceEvent); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// wait 阻塞到 event 被唤醒。event 是非阻塞的，由 runtime 的 netpoller 等待，
+// 所以关闭连接和 deadline 都可以让它返回
+func (c *shmConn) wait(event *os.File) error {
+	var buf [8]byte
+	if _, err := event.Read(buf[:]); err != nil {
+		if c.closed.Load() || errors.Is(err, os.ErrClosed) {
+			return net.ErrClosed
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *shmConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		c.closed.Store(true)
+		// 关闭 Unix domain socket 之后对方的 watchPeer 会唤醒它自己
+		err = c.conn.Close()
+		// 关闭文件会让正在等待的 Read 和 Write 返回
+		for _, f := range []*os.File{c.in.dataEvent, c.in.spaceEvent, c.out.dataEvent, c.out.spaceEvent} {
+			_ = f.Close()
+		}
+		// 等到没有人在读写共享内存之后才能解除映射
+		c.readMutex.Lock()
+		c.writeMutex.Lock()
+		_ = unix.Munmap(c.mem)
+		c.writeMutex.Unlock()
+		c.readMutex.Unlock()
+	})
+	return err
+}
+
+// NetConn 返回用来协商的 Unix domain socket，服务端通过它拿到对方进程的身份
+func (c *shmConn) NetConn() net.Conn {
+	return c.conn
+}
+
+func (c *shmConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *shmConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *shmConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *shmConn) SetReadDeadline(t time.Time) error {
+	return c.in.dataEvent.SetReadDeadline(t)
+}
+
+func (c *shmConn) SetWriteDeadline(t time.Time) error {
+	return c.out.spaceEvent.SetReadDeadline(t)
+}
@@ -0,0 +1,227 @@
+//go:build linux
+
+package go_rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShmTransport(t *testing.T) {
+	transport := &ShmTransport{RingSize: 4096}
+	server := NewServer(ServerWithTransport(transport))
+	service := &UserServiceServerPeer{}
+	server.RegisterService(service)
+	addr := filepath.Join(t.TempDir(), "go-rpc.sock")
+	go func() {
+		_ = server.Start("", addr)
+	}()
+	defer server.Close()
+	require.Eventually(t, func() bool {
+		return server.Addr() != nil
+	}, time.Second, time.Millisecond*10)
+
+	usClient := &UserService{}
+	client, err := NewClient(addr, ClientWithTransport(transport))
+	require.NoError(t, err)
+	require.NoError(t, client.InitService(usClient))
+	for i := 0; i < 100; i++ {
+		_, err = usClient.GetById(context.Background(), &GetByIdReq{Id: 123})
+		require.NoError(t, err)
+	}
+	// 身份来自用来协商的 Unix domain socket
+	require.NotNil(t, service.peer.Credentials)
+	assert.Equal(t, int32(os.Getpid()), service.peer.Credentials.Pid)
+}
+
+func TestShmListener_ResourceExhausted(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "go-rpc.sock")
+	l, err := (&ShmTransport{}).Listen(addr)
+	require.NoError(t, err)
+	defer l.Close()
+	conn, err := net.Dial("unix", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// 把文件描述符用到只剩一个，Accept 能拿到连接，但是创建不了 memfd
+	var limit unix.Rlimit
+	require.NoError(t, unix.Getrlimit(unix.RLIMIT_NOFILE, &limit))
+	entries, err := os.ReadDir("/proc/self/fd")
+	require.NoError(t, err)
+	lowered := limit
+	lowered.Cur = uint64(len(entries) + 16)
+	require.NoError(t, unix.Setrlimit(unix.RLIMIT_NOFILE, &lowered))
+	defer func() {
+		_ = unix.Setrlimit(unix.RLIMIT_NOFILE, &limit)
+	}()
+	var fds []int
+	defer func() {
+		for _, fd := range fds {
+			_ = unix.Close(fd)
+		}
+	}()
+	for {
+		fd, er := unix.Dup(0)
+		if er != nil {
+			require.ErrorIs(t, er, unix.EMFILE)
+			break
+		}
+		fds = append(fds, fd)
+	}
+	require.NoError(t, unix.Close(fds[len(fds)-1]))
+	fds = fds[:len(fds)-1]
+
+	// 资源不够的错误交给 Server 处理，而不是在 Accept 里面一直重试
+	done := make(chan error, 1)
+	go func() {
+		c, er := l.Accept()
+		if c != nil {
+			_ = c.Close()
+		}
+		done <- er
+	}()
+	select {
+	case err = <-done:
+		assert.True(t, isTemporaryAcceptErr(err), err)
+	case <-time.After(time.Second):
+		_ = l.Close()
+		t.Fatal("accept not returned")
+	}
+}
+
+func TestShmConn(t *testing.T) {
+	transport := &ShmTransport{RingSize: 4096}
+	l, err := transport.Listen(filepath.Join(t.TempDir(), "go-rpc.sock"))
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, er := l.Accept()
+		if er == nil {
+			accepted <- conn
+		}
+	}()
+	client, err := transport.Dial(context.Background(), l.Addr().String())
+	require.NoError(t, err)
+	server := <-accepted
+
+	t.Run("larger than ring", func(t *testing.T) {
+		data := make([]byte, 1<<20)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		go func() {
+			_, _ = client.Write(data)
+		}()
+		got := make([]byte, len(data))
+		_, err = io.ReadFull(server, got)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, got))
+	})
+
+	t.Run("read deadline", func(t *testing.T) {
+		require.NoError(t, server.SetReadDeadline(time.Now().Add(time.Millisecond*10)))
+		_, err := server.Read(make([]byte, 1))
+		var netErr net.Error
+		require.ErrorAs(t, err, &netErr)
+		assert.True(t, netErr.Timeout())
+		require.NoError(t, server.SetReadDeadline(time.Time{}))
+	})
+
+	t.Run("write deadline", func(t *testing.T) {
+		require.NoError(t, client.SetWriteDeadline(time.Now().Add(time.Millisecond*10)))
+		// 服务端不读，ring 写满之后就会超时
+		n, err := client.Write(make([]byte, 8192))
+		var netErr net.Error
+		require.ErrorAs(t, err, &netErr)
+		assert.True(t, netErr.Timeout())
+		assert.Equal(t, 4096, n)
+		require.NoError(t, client.SetWriteDeadline(time.Time{}))
+		_, err = io.ReadFull(server, make([]byte, n))
+		require.NoError(t, err)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		_, err := client.Write([]byte("bye"))
+		require.NoError(t, err)
+		require.NoError(t, client.Close())
+		// 关闭之前写的数据还能读到，之后是 EOF
+		bs, err := io.ReadAll(server)
+		require.NoError(t, err)
+		assert.Equal(t, "bye", string(bs))
+		_, err = server.Write([]byte("hello"))
+		assert.Error(t, err)
+		_, err = client.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, net.ErrClosed)
+		require.NoError(t, server.Close())
+	})
+}
+
+func BenchmarkTransport(b *testing.B) {
+	testCases := []struct {
+		name      string
+		transport Transport
+		addr      string
+	}{
+		{
+			name:      "tcp",
+			transport: &TCPTransport{},
+			addr:      "127.0.0.1:0",
+		},
+		{
+			name:      "unix",
+			transport: &UnixTransport{},
+			addr:      filepath.Join(b.TempDir(), "unix.sock"),
+		},
+		{
+			name:      "shm",
+			transport: &ShmTransport{},
+			addr:      filepath.Join(b.TempDir(), "shm.sock"),
+		},
+	}
+	for _, tc := range testCases {
+		b.Run(tc.name, func(b *testing.B) {
+			server := NewServer(ServerWithTransport(tc.transport))
+			// Id 为 0 的时候不会 sleep，也不会打日志
+			server.RegisterService(&UserServiceServerSlow{})
+			go func() {
+				_ = server.Start("", tc.addr)
+			}()
+			defer server.Close()
+			for server.Addr() == nil {
+				time.Sleep(time.Millisecond)
+			}
+			usClient := &UserService{}
+			client, err := NewClient(server.Addr().String(), ClientWithTransport(tc.transport))
+			require.NoError(b, err)
+			require.NoError(b, client.InitService(usClient))
+			req := &GetByIdReq{}
+
+			b.Run("serial", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := usClient.GetById(context.Background(), req); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run("parallel", func(b *testing.B) {
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if _, err := usClient.GetById(context.Background(), req); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			})
+		})
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package go_rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errShmNotSupported = errors.New("go-rpc: shm transport is only supported on linux")
+
+// ShmTransport 通过共享内存在同一台机器上的进程之间传输数据，目前只支持 Linux
+type ShmTransport struct {
+	RingSize int
+}
+
+func (t *ShmTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return nil, errShmNotSupported
+}
+
+func (t *ShmTransport) Listen(addr string) (net.Listener, error) {
+	return nil, errShmNotSupported
+}
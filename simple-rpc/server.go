@@ -30,7 +30,11 @@ func (s *Server) Start(network, addr string) error {
 	if err != nil {
 		return err
 	}
+	return s.Serve(listener)
+}
 
+// Serve 在 listener 上接收连接，直到 listener 被关闭
+func (s *Server) Serve(listener net.Listener) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -2,6 +2,7 @@ package simple_rpc
 
 import (
 	"encoding/binary"
+	"io"
 	"net"
 )
 
@@ -9,13 +10,14 @@ const numOfLengthBytes = 8
 
 func ReadMsg(conn net.Conn) ([]byte, error) {
 	lenBs := make([]byte, numOfLengthBytes)
-	_, err := conn.Read(lenBs)
+	// 一次 Read 不一定能读到全部的数据
+	_, err := io.ReadFull(conn, lenBs)
 	if err != nil {
 		return nil, err
 	}
 	length := binary.BigEndian.Uint64(lenBs)
 	data := make([]byte, length)
-	_, err = conn.Read(data)
+	_, err = io.ReadFull(conn, data)
 	return data, err
 }
 
@@ -1,25 +1,163 @@
 package go_rpc
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-rpc/internal/errs"
+	"go-rpc/message"
+	"io"
 	"net"
+	"sync"
 )
 
-const numOfLengthBytes = 8
+const (
+	numOfLengthBytes = 8
+	// minHeadLength 是请求和响应头部固定部分的长度
+	minHeadLength = 15
+	// numOfPrefixBytes 是 Version3 帧在长度前面的魔数、帧类型和标记位
+	numOfPrefixBytes = 4
 
+	DefaultMaxHeaderSize uint32 = 64 << 10
+	DefaultMaxBodySize   uint32 = 16 << 20
+)
+
+// FrameReader 从连接里面读取完整的帧。
+// 长度前缀里面声明的头部和body长度超过上限的时候直接拒绝，不会分配内存
+type FrameReader struct {
+	r             *bufio.Reader
+	maxHeaderSize uint32
+	maxBodySize   uint32
+}
+
+func NewFrameReader(r io.Reader, maxHeaderSize, maxBodySize uint32) *FrameReader {
+	return &FrameReader{
+		r:             bufio.NewReader(r),
+		maxHeaderSize: maxHeaderSize,
+		maxBodySize:   maxBodySize,
+	}
+}
+
+// ReadFrame 读取一个完整的帧，返回的数据包含长度前缀。
+// 以魔数开头的 Version3 帧，长度前缀前面还有魔数、帧类型和标记位。
+// 一个字节都没有读到就碰到 EOF 的时候返回 io.EOF
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	return readFrame(fr.r, fr.maxHeaderSize, fr.maxBodySize)
+}
+
+// ReadMsg 从 conn 读取一个完整的帧，头部和 body 的大小使用默认的上限。
+//
+// Deprecated: 使用 NewFrameReader 创建的 FrameReader，它带缓冲，并且可以设置大小上限
 func ReadMsg(conn net.Conn) ([]byte, error) {
-	lenBs := make([]byte, numOfLengthBytes)
+	return readFrame(conn, DefaultMaxHeaderSize, DefaultMaxBodySize)
+}
 
-	_, err := conn.Read(lenBs)
+// readFrame 只读取一个帧需要的数据，r 没有缓冲的时候也不会多读
+func readFrame(r io.Reader, maxHeaderSize, maxBodySize uint32) ([]byte, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return nil, wrapFrameErr(err)
+	}
+	lenBs := make([]byte, framePrefixLength(first[0])+numOfLengthBytes)
+	lenBs[0] = first[0]
+	if _, err := io.ReadFull(r, lenBs[1:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, wrapFrameErr(err)
+	}
+	length, err := frameLength(lenBs, maxHeaderSize, maxBodySize)
 	if err != nil {
 		return nil, err
 	}
 
-	headerLength := binary.BigEndian.Uint32(lenBs[:4])
-	bodyLength := binary.BigEndian.Uint32(lenBs[4:8])
-	length := bodyLength + headerLength
 	data := make([]byte, length)
-	_, err = conn.Read(data[8:])
-	copy(data[:8], lenBs)
-	return data, err
+	copy(data, lenBs)
+	if _, err = io.ReadFull(r, data[len(lenBs):]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, wrapFrameErr(err)
+	}
+	return data, nil
+}
+
+// splitFrame 从 buf 的开头切出一个完整的帧，数据还不够一个帧的时候返回 nil。
+// 返回的帧和 buf 共用内存
+func splitFrame(buf []byte, maxHeaderSize, maxBodySize uint32) ([]byte, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	n := framePrefixLength(buf[0]) + numOfLengthBytes
+	if len(buf) < n {
+		return nil, nil
+	}
+	length, err := frameLength(buf[:n], maxHeaderSize, maxBodySize)
+	if err != nil || uint64(len(buf)) < length {
+		return nil, err
+	}
+	return buf[:length], nil
+}
+
+// framePrefixLength 根据帧的第一个字节判断长度前面有没有魔数、帧类型和标记位
+func framePrefixLength(first byte) int {
+	if first == byte(message.MagicNumber>>8) {
+		return numOfPrefixBytes
+	}
+	return 0
+}
+
+// frameLength 校验长度前缀，返回整个帧的长度
+func frameLength(lenBs []byte, maxHeaderSize, maxBodySize uint32) (uint64, error) {
+	prefixLength := len(lenBs) - numOfLengthBytes
+	if prefixLength > 0 && !message.IsTyped(lenBs) {
+		return 0, fmt.Errorf("%w: bad magic number %x", errs.ErrMalformedMessage, lenBs[:2])
+	}
+
+	headerLength := binary.BigEndian.Uint32(lenBs[prefixLength : prefixLength+4])
+	bodyLength := binary.BigEndian.Uint32(lenBs[prefixLength+4:])
+	if headerLength < uint32(prefixLength+minHeadLength) {
+		return 0, fmt.Errorf("%w: header length %d", errs.ErrTruncatedFrame, headerLength)
+	}
+	if headerLength > maxHeaderSize {
+		return 0, fmt.Errorf("%w: header length %d exceeds %d", errs.ErrFrameTooLarge, headerLength, maxHeaderSize)
+	}
+	if bodyLength > maxBodySize {
+		return 0, fmt.Errorf("%w: body length %d exceeds %d", errs.ErrFrameTooLarge, bodyLength, maxBodySize)
+	}
+	return uint64(headerLength) + uint64(bodyLength), nil
+}
+
+// wrapFrameErr 把读了一半的帧碰到的 EOF 标记成 errs.ErrTruncatedFrame
+func wrapFrameErr(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", errs.ErrTruncatedFrame, err)
+	}
+	return err
+}
+
+// FrameWriter 把帧完整地写进连接，可以被多个 goroutine 并发使用。
+// 每个帧只调用一次 Write，不需要写缓冲，空闲的连接不会占用内存
+type FrameWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+	// err 是第一次写失败的错误。连接上可能留下了半个帧，之后的帧都不能再写
+	err error
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{
+		w: w,
+	}
+}
+
+func (fw *FrameWriter) WriteFrame(data []byte) error {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	if fw.err != nil {
+		return fw.err
+	}
+	_, fw.err = fw.w.Write(data)
+	return fw.err
 }
@@ -0,0 +1,154 @@
+package go_rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-rpc/internal/errs"
+	"go-rpc/message"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameReader_ReadFrame(t *testing.T) {
+	req := &message.Request{
+		ServiceName: "user-service",
+		MethodName:  "GetById",
+		Data:        []byte("hello world"),
+	}
+	req.CalculateHeaderLength()
+	req.CalculateBodyLength()
+	frame := req.Encode()
+
+	typedReq := &message.Request{
+		Kind:        message.KindRequest,
+		Version:     message.Version3,
+		ServiceName: "user-service",
+		MethodName:  "GetById",
+		Data:        []byte("hello world"),
+	}
+	typedReq.CalculateHeaderLength()
+	typedReq.CalculateBodyLength()
+	typedFrame := typedReq.Encode()
+	badMagic := bytes.Clone(typedFrame)
+	badMagic[1] = 0
+
+	hugeHeader := make([]byte, numOfLengthBytes)
+	binary.BigEndian.PutUint32(hugeHeader[:4], 1<<32-1)
+
+	hugeBody := make([]byte, numOfLengthBytes)
+	binary.BigEndian.PutUint32(hugeBody[:4], minHeadLength)
+	binary.BigEndian.PutUint32(hugeBody[4:], 1<<32-1)
+
+	testCases := []struct {
+		name    string
+		input   io.Reader
+		want    []byte
+		wantErr error
+	}{
+		{
+			name:  "normal",
+			input: bytes.NewReader(frame),
+			want:  frame,
+		},
+		{
+			name:  "short reads",
+			input: iotest.OneByteReader(bytes.NewReader(frame)),
+			want:  frame,
+		},
+		{
+			name:  "typed",
+			input: iotest.OneByteReader(bytes.NewReader(typedFrame)),
+			want:  typedFrame,
+		},
+		{
+			name:    "bad magic",
+			input:   bytes.NewReader(badMagic),
+			wantErr: errs.ErrMalformedMessage,
+		},
+		{
+			name:    "truncated typed",
+			input:   bytes.NewReader(typedFrame[:len(typedFrame)-1]),
+			wantErr: errs.ErrTruncatedFrame,
+		},
+		{
+			name:    "eof",
+			input:   bytes.NewReader(nil),
+			wantErr: io.EOF,
+		},
+		{
+			name:    "truncated length",
+			input:   bytes.NewReader(frame[:4]),
+			wantErr: errs.ErrTruncatedFrame,
+		},
+		{
+			name:    "truncated body",
+			input:   bytes.NewReader(frame[:len(frame)-1]),
+			wantErr: errs.ErrTruncatedFrame,
+		},
+		{
+			name:    "header too large",
+			input:   bytes.NewReader(hugeHeader),
+			wantErr: errs.ErrFrameTooLarge,
+		},
+		{
+			name:    "body too large",
+			input:   bytes.NewReader(hugeBody),
+			wantErr: errs.ErrFrameTooLarge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fr := NewFrameReader(tc.input, DefaultMaxHeaderSize, DefaultMaxBodySize)
+			data, err := fr.ReadFrame()
+			assert.ErrorIs(t, err, tc.wantErr)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tc.want, data)
+		})
+	}
+}
+
+func TestReadMsg(t *testing.T) {
+	first := newGetByIdReq(1, message.Version2).Encode()
+	second := newGetByIdReq(2, message.Version3).Encode()
+	cConn, sConn := net.Pipe()
+	defer cConn.Close()
+	go func() {
+		_, _ = sConn.Write(append(bytes.Clone(first), second...))
+		_ = sConn.Close()
+	}()
+
+	// 没有缓冲，连续读取的时候不会丢掉后面的帧
+	data, err := ReadMsg(cConn)
+	require.NoError(t, err)
+	assert.Equal(t, first, data)
+	data, err = ReadMsg(cConn)
+	require.NoError(t, err)
+	assert.Equal(t, second, data)
+	_, err = ReadMsg(cConn)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFrameWriter_WriteFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+	fw := NewFrameWriter(buf)
+	fr := NewFrameReader(buf, DefaultMaxHeaderSize, DefaultMaxBodySize)
+
+	res := &message.Response{Data: []byte("hello world")}
+	res.CalculateHeaderLength()
+	res.CalculateBodyLength()
+	require.NoError(t, fw.WriteFrame(res.Encode()))
+	require.NoError(t, fw.WriteFrame(res.Encode()))
+
+	for i := 0; i < 2; i++ {
+		data, err := fr.ReadFrame()
+		require.NoError(t, err)
+		assert.Equal(t, res.Encode(), data)
+	}
+}
@@ -0,0 +1,154 @@
+package go_rpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "server", time.Hour, func(tmpl *x509.Certificate) {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	})
+	spiffe, err := url.Parse("spiffe://example.org/ns/default/sa/order")
+	require.NoError(t, err)
+	clientCert := ca.issue(t, "order-service", time.Hour, func(tmpl *x509.Certificate) {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		tmpl.DNSNames = []string{"order.example.org"}
+		tmpl.URIs = []*url.URL{spiffe}
+	})
+
+	server := NewServer(ServerWithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}))
+	service := &UserServiceServerPeer{}
+	server.RegisterService(service)
+	addr := startServer(t, server)
+
+	t.Run("mutual tls", func(t *testing.T) {
+		usClient := &UserService{}
+		client, err := NewClient(addr, ClientWithTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      ca.pool,
+		}))
+		require.NoError(t, err)
+		require.NoError(t, client.InitService(usClient))
+		resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 123})
+		require.NoError(t, err)
+		assert.Equal(t, "order-service", resp.Msg)
+
+		p := service.peer
+		require.NotNil(t, p)
+		assert.NotNil(t, p.TLS)
+		assert.Equal(t, "order-service", p.Subject.CommonName)
+		assert.Equal(t, []string{"order.example.org"}, p.DNSNames)
+		assert.Equal(t, spiffe.String(), p.SPIFFEID)
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		client, err := NewClient(addr, ClientWithTLSConfig(&tls.Config{
+			RootCAs: ca.pool,
+		}))
+		// TLS 1.3 里面客户端证书的错误在握手之后才会被客户端发现
+		if err == nil {
+			usClient := &UserService{}
+			require.NoError(t, client.InitService(usClient))
+			_, err = usClient.GetById(context.Background(), &GetByIdReq{Id: 123})
+		}
+		assert.Error(t, err)
+	})
+
+	t.Run("untrusted server", func(t *testing.T) {
+		_, err := NewClient(addr, ClientWithTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+		}))
+		assert.Error(t, err)
+	})
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go-rpc test ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour * 24),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, cn string, ttl time.Duration, fn func(tmpl *x509.Certificate)) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	fn(tmpl)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+// UserServiceServerPeer 返回调用方证书里面的名字
+type UserServiceServerPeer struct {
+	peer *Peer
+}
+
+func (u *UserServiceServerPeer) GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	p, ok := PeerFromContext(ctx)
+	if !ok {
+		return nil, errors.New("no peer")
+	}
+	u.peer = p
+	return &GetByIdResp{
+		Msg: p.Subject.CommonName,
+	}, nil
+}
+
+func (u *UserServiceServerPeer) Name() string {
+	return "user-service"
+}
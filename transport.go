@@ -0,0 +1,191 @@
+package go_rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultShmRingSize 是 ShmTransport 每个方向的 ring buffer 的默认大小
+const DefaultShmRingSize = 1 << 20
+
+// Transport 负责建立连接。客户端用 Dial 连接服务端，服务端用 Listen 接收连接
+type Transport interface {
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+type frameLimitsKey struct{}
+
+type frameLimits struct {
+	maxHeaderSize uint32
+	maxBodySize   uint32
+}
+
+// ctxWithFrameLimits 把客户端的帧大小上限传给 Dial，一次读取整个响应的 Transport 用它限制读取的数据量
+func ctxWithFrameLimits(ctx context.Context, maxHeaderSize, maxBodySize uint32) context.Context {
+	return context.WithValue(ctx, frameLimitsKey{}, frameLimits{maxHeaderSize: maxHeaderSize, maxBodySize: maxBodySize})
+}
+
+// frameLimitsFromContext 返回 ctx 里面的帧大小上限，没有设置的时候使用默认值
+func frameLimitsFromContext(ctx context.Context) (maxHeaderSize, maxBodySize uint32) {
+	if limits, ok := ctx.Value(frameLimitsKey{}).(frameLimits); ok {
+		return limits.maxHeaderSize, limits.maxBodySize
+	}
+	return DefaultMaxHeaderSize, DefaultMaxBodySize
+}
+
+// TCPTransport 是默认的 Transport
+type TCPTransport struct {
+}
+
+func (t *TCPTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (t *TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// UnixTransport 使用 Unix domain socket，addr 是 socket 文件的路径。
+// 在 Linux 上 @ 开头的 addr 表示 abstract namespace，不会创建文件
+type UnixTransport struct {
+}
+
+func (t *UnixTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", addr)
+}
+
+func (t *UnixTransport) Listen(addr string) (net.Listener, error) {
+	return listenUnix(addr)
+}
+
+// listenUnix 监听 Unix domain socket。
+// 进程异常退出会留下 socket 文件，如果已经没有进程在上面监听就先删掉它
+func listenUnix(addr string) (net.Listener, error) {
+	if addr != "" && addr[0] != '@' {
+		if info, err := os.Stat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, er := net.Dial("unix", addr); er == nil {
+				_ = conn.Close()
+			} else {
+				_ = os.Remove(addr)
+			}
+		}
+	}
+	return net.Listen("unix", addr)
+}
+
+// unixScheme 是客户端地址里面表示 Unix domain socket 的前缀，
+// 例如 unix:///var/run/go-rpc.sock 或者 unix:@go-rpc
+const unixScheme = "unix:"
+
+// parseAddr 根据地址的前缀选择默认的 Transport
+func parseAddr(addr string) (Transport, string) {
+	if strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://") {
+		return &WebSocketTransport{}, addr
+	}
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		return &HTTPTransport{}, addr
+	}
+	if rest, ok := strings.CutPrefix(addr, unixScheme); ok {
+		// unix:///path 和 unix:/path 都表示绝对路径
+		if path, isURL := strings.CutPrefix(rest, "//"); isURL {
+			rest = path
+		}
+		return &UnixTransport{}, rest
+	}
+	return &TCPTransport{}, addr
+}
+
+// MemoryTransport 在同一个进程里面用 net.Pipe 建立连接，不会占用任何端口，
+// 一般用在测试里面。同一个 MemoryTransport 上的客户端和服务端才能互相连接
+type MemoryTransport struct {
+	mutex     sync.Mutex
+	listeners map[string]*memoryListener
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		listeners: make(map[string]*memoryListener, 4),
+	}
+}
+
+func (t *MemoryTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	t.mutex.Lock()
+	l, ok := t.listeners[addr]
+	t.mutex.Unlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: "memory", Addr: memoryAddr(addr), Err: errors.New("connection refused")}
+	}
+	cConn, sConn := net.Pipe()
+	select {
+	case l.conns <- sConn:
+		return cConn, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "dial", Net: "memory", Addr: l.addr, Err: errors.New("connection refused")}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *MemoryTransport) Listen(addr string) (net.Listener, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "memory", Addr: memoryAddr(addr), Err: errors.New("address already in use")}
+	}
+	l := &memoryListener{
+		t:      t,
+		addr:   memoryAddr(addr),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	t.listeners[addr] = l
+	return l, nil
+}
+
+type memoryListener struct {
+	t      *MemoryTransport
+	addr   memoryAddr
+	conns  chan net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.t.mutex.Lock()
+		delete(l.t.listeners, string(l.addr))
+		l.t.mutex.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,86 @@
+package go_rpc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTransport(t *testing.T) {
+	testCases := []struct {
+		name      string
+		transport Transport
+		addr      string
+	}{
+		{
+			name:      "tcp",
+			transport: &TCPTransport{},
+			addr:      "127.0.0.1:0",
+		},
+		{
+			name:      "unix",
+			transport: &UnixTransport{},
+			addr:      filepath.Join(t.TempDir(), "go-rpc.sock"),
+		},
+		{
+			name:      "memory",
+			transport: NewMemoryTransport(),
+			addr:      "user-service",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer(ServerWithTransport(tc.transport))
+			server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+			go func() {
+				_ = server.Start("", tc.addr)
+			}()
+			defer server.Close()
+			require.Eventually(t, func() bool {
+				return server.Addr() != nil
+			}, time.Second, time.Millisecond*10)
+
+			usClient := &UserService{}
+			client, err := NewClient(server.Addr().String(), ClientWithTransport(tc.transport))
+			require.NoError(t, err)
+			require.NoError(t, client.InitService(usClient))
+			resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 123})
+			require.NoError(t, err)
+			assert.Equal(t, &GetByIdResp{Msg: "hello, world"}, resp)
+		})
+	}
+}
+
+func TestMemoryTransport(t *testing.T) {
+	transport := NewMemoryTransport()
+	_, err := transport.Dial(context.Background(), "user-service")
+	assert.Error(t, err)
+
+	l, err := transport.Listen("user-service")
+	require.NoError(t, err)
+	_, err = transport.Listen("user-service")
+	assert.Error(t, err)
+
+	go func() {
+		conn, er := l.Accept()
+		if er == nil {
+			_, _ = conn.Write([]byte("hello"))
+		}
+	}()
+	conn, err := transport.Dial(context.Background(), "user-service")
+	require.NoError(t, err)
+	bs := make([]byte, 5)
+	_, err = conn.Read(bs)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(bs))
+
+	require.NoError(t, l.Close())
+	_, err = l.Accept()
+	assert.Error(t, err)
+	_, err = transport.Dial(context.Background(), "user-service")
+	assert.Error(t, err)
+}
@@ -0,0 +1,539 @@
+package go_rpc
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// websocketGUID 用来计算 Sec-WebSocket-Accept，见 RFC 6455 1.3
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// WebSocketProtocol 是 go-rpc 使用的子协议
+	WebSocketProtocol = "go-rpc"
+	// websocketHandshakeTimeout 限制 HTTP 升级的时间
+	websocketHandshakeTimeout = time.Second * 10
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	// wsMaxControlPayload 是控制帧 payload 的最大长度
+	wsMaxControlPayload = 125
+)
+
+var errWebSocketProtocol = errors.New("go-rpc: websocket protocol error")
+
+// WebSocketTransport 通过 WebSocket 传输数据，浏览器可以直接调用服务。
+// 每个 go-rpc 帧是一个 binary 消息，握手和分帧按照 RFC 6455 实现。
+// 客户端的地址可以是 ws://host:port/path、wss://host:port/path 或者 host:port。
+// TLS 要在 WebSocket 下面，所以 wss 使用 TLSConfig，而不是 ServerWithTLSConfig 和 ClientWithTLSConfig
+type WebSocketTransport struct {
+	// Path 是服务端接受升级的路径，为空的时候接受所有路径。
+	// 客户端的地址里面没有路径的时候也使用它
+	Path string
+	// TLSConfig 不为 nil 的时候服务端监听 wss，客户端连接 ws:// 以外的地址也使用 wss
+	TLSConfig *tls.Config
+	// CheckOrigin 校验浏览器的 Origin 头部。
+	// 为 nil 的时候只接受没有 Origin 或者 Origin 和 Host 一致的请求
+	CheckOrigin func(r *http.Request) bool
+}
+
+func (t *WebSocketTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	u, err := t.parseURL(addr)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		config := t.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	wc, err := websocketClientHandshake(ctx, conn, u)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return wc, nil
+}
+
+func (t *WebSocketTransport) parseURL(addr string) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		scheme := "ws"
+		if t.TLSConfig != nil {
+			scheme = "wss"
+		}
+		addr = scheme + "://" + addr + t.Path
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("go-rpc: unsupported websocket scheme %q", u.Scheme)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+func (t *WebSocketTransport) Listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.TLSConfig != nil {
+		listener = tls.NewListener(listener, t.TLSConfig)
+	}
+	return NewWebSocketListener(listener, t.Path, t.CheckOrigin), nil
+}
+
+// NewWebSocketListener 在 listener 接收的连接上完成 WebSocket 升级。
+// 可以用它让同一个 Server 同时通过 TCP 和 WebSocket 提供服务
+func NewWebSocketListener(listener net.Listener, path string, checkOrigin func(r *http.Request) bool) net.Listener {
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	l := &wsListener{
+		Listener:    listener,
+		path:        path,
+		checkOrigin: checkOrigin,
+		conns:       make(chan net.Conn),
+		closed:      make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// wsListener 在单独的 goroutine 里面接收连接并且升级，慢的客户端不会阻塞 Accept
+type wsListener struct {
+	net.Listener
+	path        string
+	checkOrigin func(r *http.Request) bool
+
+	conns     chan net.Conn
+	err       error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// acceptLoop 接收连接，暂时的错误等一会儿重试，其它错误让 Accept 返回并且关闭 listener
+func (l *wsListener) acceptLoop() {
+	var backoff acceptBackoff
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if isTemporaryAcceptErr(err) && !l.isClosed() {
+				backoff.wait()
+				continue
+			}
+			l.closeOnce.Do(func() {
+				l.err = err
+				close(l.closed)
+			})
+			return
+		}
+		backoff.reset()
+		go func() {
+			wc, er := l.upgrade(conn)
+			if er != nil {
+				_ = conn.Close()
+				return
+			}
+			select {
+			case l.conns <- wc:
+			case <-l.closed:
+				_ = wc.Close()
+			}
+		}()
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, l.err
+	}
+}
+
+func (l *wsListener) isClosed() bool {
+	select {
+	case <-l.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *wsListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() {
+		l.err = net.ErrClosed
+		close(l.closed)
+	})
+	return err
+}
+
+// upgrade 完成服务端的握手，失败的时候回复对应的 HTTP 状态码
+func (l *wsListener) upgrade(conn net.Conn) (*wsConn, error) {
+	_ = conn.SetDeadline(time.Now().Add(websocketHandshakeTimeout))
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+	status, err := l.check(req)
+	if err != nil {
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n",
+			status, http.StatusText(status))
+		return nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(req.Header.Get("Sec-WebSocket-Key")) + "\r\n"
+	if headerContains(req.Header, "Sec-WebSocket-Protocol", WebSocketProtocol) {
+		resp += "Sec-WebSocket-Protocol: " + WebSocketProtocol + "\r\n"
+	}
+	if _, err = io.WriteString(conn, resp+"\r\n"); err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return newWsConn(conn, br, false), nil
+}
+
+func (l *wsListener) check(req *http.Request) (int, error) {
+	if l.path != "" && req.URL.Path != l.path {
+		return http.StatusNotFound, fmt.Errorf("%w: unexpected path %s", errWebSocketProtocol, req.URL.Path)
+	}
+	if req.Method != http.MethodGet ||
+		!headerContains(req.Header, "Connection", "upgrade") ||
+		!headerContains(req.Header, "Upgrade", "websocket") {
+		return http.StatusBadRequest, fmt.Errorf("%w: not a websocket upgrade", errWebSocketProtocol)
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return http.StatusBadRequest, fmt.Errorf("%w: unsupported version", errWebSocketProtocol)
+	}
+	if key, err := base64.StdEncoding.DecodeString(req.Header.Get("Sec-WebSocket-Key")); err != nil || len(key) != 16 {
+		return http.StatusBadRequest, fmt.Errorf("%w: bad key", errWebSocketProtocol)
+	}
+	if !l.checkOrigin(req) {
+		return http.StatusForbidden, fmt.Errorf("%w: origin not allowed", errWebSocketProtocol)
+	}
+	return 0, nil
+}
+
+// sameOrigin 只接受非浏览器的客户端，或者和服务端同源的页面
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func websocketClientHandshake(ctx context.Context, conn net.Conn, u *url.URL) (*wsConn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-WebSocket-Key":      {encodedKey},
+			"Sec-WebSocket-Version":  {"13"},
+			"Sec-WebSocket-Protocol": {WebSocketProtocol},
+		},
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%w: unexpected status %s", errWebSocketProtocol, resp.Status)
+	}
+	if !headerContains(resp.Header, "Upgrade", "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(encodedKey) {
+		return nil, fmt.Errorf("%w: bad handshake response", errWebSocketProtocol)
+	}
+	return newWsConn(conn, br, true), nil
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains 判断用逗号分隔的头部里面有没有 token，不区分大小写
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn 把 WebSocket 连接包装成字节流。
+// 每次 Write 发送一个 binary 消息，Read 把收到的消息拼接起来，
+// ping 和 close 这些控制帧在 Read 里面处理
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+	// client 为 true 的时候发送的帧需要 mask，收到的帧不能有 mask
+	client bool
+
+	// 当前正在读的帧还剩下的数据
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	writeMutex sync.Mutex
+	closeSent  bool
+}
+
+func newWsConn(conn net.Conn, br *bufio.Reader, client bool) *wsConn {
+	return &wsConn{Conn: conn, br: br, client: client}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame 读取下一个数据帧的头部，控制帧直接在这里处理
+func (c *wsConn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return err
+	}
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0F
+	if head[0]&0x70 != 0 {
+		return c.fail(wsCloseProtocol, "reserved bits set")
+	}
+	masked := head[1]&0x80 != 0
+	// 客户端发的帧必须 mask，服务端发的帧不能 mask
+	if masked == c.client {
+		return c.fail(wsCloseProtocol, "bad mask")
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var bs [2]byte
+		if _, err := io.ReadFull(c.br, bs[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(bs[:]))
+	case 127:
+		var bs [8]byte
+		if _, err := io.ReadFull(c.br, bs[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(bs[:])
+		if length>>63 != 0 {
+			return c.fail(wsCloseProtocol, "bad length")
+		}
+	}
+	c.masked = masked
+	c.maskPos = 0
+	if masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsOpBinary, wsOpContinuation:
+		c.remaining = length
+		return nil
+	case wsOpText:
+		return c.fail(wsCloseUnsupported, "text message")
+	case wsOpPing, wsOpPong, wsOpClose:
+	default:
+		return c.fail(wsCloseProtocol, "unknown opcode")
+	}
+
+	if !fin || length > wsMaxControlPayload {
+		return c.fail(wsCloseProtocol, "bad control frame")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	c.unmask(payload)
+	switch opcode {
+	case wsOpPing:
+		return c.writeFrame(wsOpPong, payload)
+	case wsOpClose:
+		// 回复对方的 close，然后当作连接已经结束
+		code := uint16(wsCloseNormal)
+		if len(payload) >= 2 {
+			code = binary.BigEndian.Uint16(payload)
+		}
+		_ = c.writeClose(code)
+		return io.EOF
+	}
+	return nil
+}
+
+func (c *wsConn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// fail 告诉对方协议出错了，然后关闭连接
+func (c *wsConn) fail(code uint16, reason string) error {
+	_ = c.writeClose(code)
+	_ = c.Conn.Close()
+	return fmt.Errorf("%w: %s", errWebSocketProtocol, reason)
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	return c.writeFrameLocked(opcode, payload)
+}
+
+func (c *wsConn) writeFrameLocked(opcode byte, payload []byte) error {
+	head := make([]byte, 2, 14)
+	head[0] = 0x80 | opcode
+	switch length := len(payload); {
+	case length < 126:
+		head[1] = byte(length)
+	case length <= 0xFFFF:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(length))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(length))
+	}
+	if !c.client {
+		_, err := (&net.Buffers{head, payload}).WriteTo(c.Conn)
+		return err
+	}
+	// 客户端的 payload 需要 mask，不能修改调用者的数据
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	head[1] |= 0x80
+	head = append(head, mask[:]...)
+	frame := make([]byte, len(head)+len(payload))
+	copy(frame, head)
+	for i, b := range payload {
+		frame[len(head)+i] = b ^ mask[i&3]
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) writeClose(code uint16) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	return c.writeFrameLocked(wsOpClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// Close 发送 close 帧之后关闭连接，不等待对方回复
+func (c *wsConn) Close() error {
+	_ = c.writeClose(wsCloseNormal)
+	return c.Conn.Close()
+}
+
+// NetConn 返回 WebSocket 下面的连接
+func (c *wsConn) NetConn() net.Conn {
+	return c.Conn
+}
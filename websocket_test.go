@@ -0,0 +1,307 @@
+package go_rpc
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWebSocketTransport(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "server", time.Hour, func(tmpl *x509.Certificate) {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	})
+
+	testCases := []struct {
+		name            string
+		serverTransport *WebSocketTransport
+		clientOpts      []ClientOption
+		scheme          string
+		path            string
+	}{
+		{
+			name:            "ws",
+			serverTransport: &WebSocketTransport{Path: "/rpc"},
+			scheme:          "ws://",
+			path:            "/rpc",
+		},
+		{
+			name: "wss",
+			serverTransport: &WebSocketTransport{TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{serverCert},
+			}},
+			clientOpts: []ClientOption{ClientWithTransport(&WebSocketTransport{
+				TLSConfig: &tls.Config{RootCAs: ca.pool},
+			})},
+			scheme: "wss://",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer(ServerWithTransport(tc.serverTransport))
+			server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+			go func() {
+				_ = server.Start("", "127.0.0.1:0")
+			}()
+			defer server.Close()
+			require.Eventually(t, func() bool {
+				return server.Addr() != nil
+			}, time.Second, time.Millisecond*10)
+
+			usClient := &UserService{}
+			client, err := NewClient(tc.scheme+server.Addr().String()+tc.path, tc.clientOpts...)
+			require.NoError(t, err)
+			require.NoError(t, client.InitService(usClient))
+			resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 123})
+			require.NoError(t, err)
+			assert.Equal(t, &GetByIdResp{Msg: "hello, world"}, resp)
+		})
+	}
+}
+
+func TestWebSocketTransport_MutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "server", time.Hour, func(tmpl *x509.Certificate) {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	})
+	clientCert := ca.issue(t, "order-service", time.Hour, func(tmpl *x509.Certificate) {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	})
+	server := NewServer(ServerWithTransport(&WebSocketTransport{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}}))
+	service := &UserServiceServerPeer{}
+	server.RegisterService(service)
+	go func() {
+		_ = server.Start("", "127.0.0.1:0")
+	}()
+	defer server.Close()
+	require.Eventually(t, func() bool {
+		return server.Addr() != nil
+	}, time.Second, time.Millisecond*10)
+
+	usClient := &UserService{}
+	client, err := NewClient("wss://"+server.Addr().String(), ClientWithTransport(&WebSocketTransport{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      ca.pool,
+		},
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.InitService(usClient))
+	resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 123})
+	require.NoError(t, err)
+	// TLS 在 WebSocket 下面，服务端也要拿到客户端证书
+	assert.Equal(t, "order-service", resp.Msg)
+	require.NotNil(t, service.peer)
+	assert.NotNil(t, service.peer.TLS)
+	assert.Equal(t, "order-service", service.peer.Certificate.Subject.CommonName)
+}
+
+func TestWebSocketListener_AlongsideTCP(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+	tcpAddr := startServer(t, server)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = server.Serve(NewWebSocketListener(l, "", nil))
+	}()
+
+	for _, addr := range []string{tcpAddr, "ws://" + l.Addr().String()} {
+		usClient := &UserService{}
+		client, err := NewClient(addr)
+		require.NoError(t, err)
+		require.NoError(t, client.InitService(usClient))
+		resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 123})
+		require.NoError(t, err)
+		assert.Equal(t, "hello, world", resp.Msg)
+	}
+}
+
+func TestWebSocketListener_AcceptTemporaryError(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	flaky := &flakyListener{Listener: l}
+	flaky.failures.Store(3)
+	go func() {
+		_ = server.Serve(NewWebSocketListener(flaky, "/", nil))
+	}()
+	defer server.Close()
+
+	// 暂时的错误过去之后继续接收连接
+	client, err := NewClient("ws://" + l.Addr().String() + "/")
+	require.NoError(t, err)
+	defer client.Close()
+	usClient := &UserService{}
+	require.NoError(t, client.InitService(usClient))
+	resp, err := usClient.GetById(context.Background(), &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", resp.Msg)
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	transport := &WebSocketTransport{Path: "/rpc"}
+	l, err := transport.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	addr := "http://" + l.Addr().String()
+
+	testCases := []struct {
+		name       string
+		path       string
+		header     http.Header
+		wantStatus int
+	}{
+		{
+			name:       "not upgrade",
+			path:       "/rpc",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "wrong path",
+			path: "/other",
+			header: http.Header{
+				"Upgrade":               {"websocket"},
+				"Connection":            {"Upgrade"},
+				"Sec-WebSocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+				"Sec-WebSocket-Version": {"13"},
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name: "cross origin",
+			path: "/rpc",
+			header: http.Header{
+				"Upgrade":               {"websocket"},
+				"Connection":            {"Upgrade"},
+				"Sec-WebSocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+				"Sec-WebSocket-Version": {"13"},
+				"Origin":                {"https://evil.example.com"},
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "upgrade",
+			path: "/rpc",
+			header: http.Header{
+				"Upgrade":                {"websocket"},
+				"Connection":             {"keep-alive, Upgrade"},
+				"Sec-WebSocket-Key":      {"dGhlIHNhbXBsZSBub25jZQ=="},
+				"Sec-WebSocket-Version":  {"13"},
+				"Sec-WebSocket-Protocol": {"chat, go-rpc"},
+			},
+			wantStatus: http.StatusSwitchingProtocols,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, addr+tc.path, nil)
+			require.NoError(t, err)
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.wantStatus, resp.StatusCode)
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				// RFC 6455 里面的例子
+				assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+				assert.Equal(t, WebSocketProtocol, resp.Header.Get("Sec-WebSocket-Protocol"))
+			}
+		})
+	}
+}
+
+func TestWsConn(t *testing.T) {
+	newPair := func() (*wsConn, net.Conn) {
+		cConn, sConn := net.Pipe()
+		t.Cleanup(func() {
+			_ = cConn.Close()
+			_ = sConn.Close()
+		})
+		return newWsConn(sConn, bufio.NewReader(sConn), false), cConn
+	}
+	// frame 构造一个客户端发出的帧
+	frame := func(head byte, payload []byte, masked bool) []byte {
+		bs := []byte{head, byte(len(payload))}
+		if !masked {
+			return append(bs, payload...)
+		}
+		mask := []byte{1, 2, 3, 4}
+		bs[1] |= 0x80
+		bs = append(bs, mask...)
+		for i, b := range payload {
+			bs = append(bs, b^mask[i&3])
+		}
+		return bs
+	}
+
+	t.Run("fragmented message and ping", func(t *testing.T) {
+		server, client := newPair()
+		go func() {
+			_, _ = client.Write(frame(wsOpBinary, []byte("hello, "), true))
+			_, _ = client.Write(frame(0x80|wsOpPing, []byte("ping"), true))
+			_, _ = client.Write(frame(0x80|wsOpContinuation, []byte("world"), true))
+		}()
+		pong := make(chan []byte, 1)
+		go func() {
+			bs := make([]byte, 6)
+			_, _ = io.ReadFull(client, bs)
+			pong <- bs
+		}()
+		bs := make([]byte, 12)
+		_, err := io.ReadFull(server, bs)
+		require.NoError(t, err)
+		assert.Equal(t, "hello, world", string(bs))
+		assert.Equal(t, append([]byte{0x80 | wsOpPong, 4}, "ping"...), <-pong)
+	})
+
+	t.Run("unmasked frame", func(t *testing.T) {
+		server, client := newPair()
+		go func() {
+			_, _ = client.Write(frame(0x80|wsOpBinary, []byte("hello"), false))
+		}()
+		closeFrame := make(chan []byte, 1)
+		go func() {
+			bs := make([]byte, 4)
+			_, _ = io.ReadFull(client, bs)
+			closeFrame <- bs
+		}()
+		_, err := server.Read(make([]byte, 5))
+		assert.ErrorIs(t, err, errWebSocketProtocol)
+		bs := <-closeFrame
+		assert.Equal(t, byte(0x80|wsOpClose), bs[0])
+		assert.Equal(t, uint16(wsCloseProtocol), binary.BigEndian.Uint16(bs[2:]))
+	})
+
+	t.Run("close", func(t *testing.T) {
+		server, client := newPair()
+		go func() {
+			_, _ = client.Write(frame(0x80|wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal), true))
+			_, _ = io.Copy(io.Discard, client)
+		}()
+		_, err := server.Read(make([]byte, 5))
+		assert.Equal(t, io.EOF, err)
+		_, err = server.Write([]byte("hello"))
+		assert.Error(t, err)
+	})
+}